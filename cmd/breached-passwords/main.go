@@ -0,0 +1,71 @@
+// Converts the Pwned Passwords SHA-1 list ("HASH:COUNT" lines sorted by hash)
+// from stdin into the binary format read by passpolicy.BreachedList.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var outFileName = flag.String("out", "breached-passwords.bin", "output file")
+var minCount = flag.Int("min-count", 1, "skip hashes seen in fewer breaches than this")
+
+func main() {
+	flag.Parse()
+
+	out, err := os.Create(*outFileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(out)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	var prev []byte
+	written := 0
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		hashHex, countStr, hasCount := strings.Cut(line, ":")
+		if hasCount {
+			count, err := strconv.Atoi(countStr)
+			if err != nil {
+				log.Fatalf("line %v: invalid count %q", lineNo, countStr)
+			}
+			if count < *minCount {
+				continue
+			}
+		}
+		hash, err := hex.DecodeString(hashHex)
+		if err != nil || len(hash) != 20 {
+			log.Fatalf("line %v: invalid SHA-1 hash %q", lineNo, hashHex)
+		}
+		if prev != nil && bytes.Compare(prev, hash) >= 0 {
+			log.Fatalf("line %v: hashes are not sorted", lineNo)
+		}
+		if _, err := w.Write(hash); err != nil {
+			log.Fatal(err)
+		}
+		prev = hash
+		written++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %v hashes to %v\n", written, *outFileName)
+}
@@ -8,6 +8,9 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+
+	"github.com/oskarrrrrrr/sudoku-web/internal/csrf"
 )
 
 var UI_DIR string = filepath.Join("ui", "src")
@@ -99,11 +102,41 @@ func login(header template.HTML) {
 		"login.html", "login.html", "login",
 		struct{ Header template.HTML }{Header: header},
 	)
+	renderTemplate(
+		"two-factor.html", "two-factor.html", "two-factor",
+		struct{ Header template.HTML }{Header: header},
+	)
+	renderTemplate(
+		"auth-message.html", "oidc-login-failed.html", "oidc-login-failed",
+		authMessageInput{
+			Header:   header,
+			Message:  "Logging in failed. Try again or use your email and password.",
+			LinkHref: "/login",
+			LinkText: "Log In",
+		},
+	)
+	renderTemplate(
+		"magic-login.html", "magic-login.html", "magic-login",
+		struct{ Header template.HTML }{Header: header},
+	)
+	renderTemplate(
+		"auth-message.html", "login-link-sent.html", "login-link-sent",
+		authMessageInput{
+			Header:  header,
+			Message: "If an account with this email exists, we sent you a link to log in.",
+		},
+	)
+	renderTemplate(
+		"login-link.html", "login-link.html", "login-link",
+		struct{ Header template.HTML }{Header: header},
+	)
 }
 
 type authMessageInput struct {
-	Header  template.HTML
-	Message string
+	Header   template.HTML
+	Message  string
+	LinkHref string
+	LinkText string
 }
 
 func register(header template.HTML) {
@@ -132,9 +165,32 @@ func verification(header template.HTML) {
 		"auth-message.html", "verification-failed.html", "verification-failed",
 		authMessageInput {
             Header: header,
-            Message: "Verification failed. Invalid or expired token. Register again.",
+            Message: "Verification failed. Invalid or expired token.",
+            LinkHref: "/resend-verification",
+            LinkText: "Get a New Link",
         },
 	)
+	renderTemplate(
+		"resend-verification.html", "resend-verification.html", "resend-verification",
+		struct{ Header template.HTML }{Header: header},
+	)
+}
+
+func email_change(header template.HTML) {
+	renderTemplate(
+		"auth-message.html", "email-change-succeeded.html", "email-change-succeeded",
+		authMessageInput{
+			Header:  header,
+			Message: "Email changed. Use the new email to log in.",
+		},
+	)
+	renderTemplate(
+		"auth-message.html", "email-change-failed.html", "email-change-failed",
+		authMessageInput{
+			Header:  header,
+			Message: "Email change failed. Invalid or expired token.",
+		},
+	)
 }
 
 func forgot_password(header template.HTML) {
@@ -142,18 +198,48 @@ func forgot_password(header template.HTML) {
 		"forgot-password.html", "forgot-password.html", "forgot-password",
 		struct{ Header template.HTML }{Header: header},
 	)
+	renderTemplate(
+		"auth-message.html", "password-reset-requested.html", "password-reset-requested",
+		authMessageInput{
+			Header:  header,
+			Message: "If an account with this email exists, we sent you a link to reset your password.",
+		},
+	)
+	renderTemplate(
+		"reset-password.html", "reset-password.html", "reset-password",
+		struct{ Header template.HTML }{Header: header},
+	)
+	renderTemplate(
+		"auth-message.html", "password-reset-complete.html", "password-reset-complete",
+		authMessageInput{
+			Header:  header,
+			Message: "Password changed. You can now log in with your new password.",
+		},
+	)
+}
+
+// The CSRF token is different for every browser, the server replaces the
+// placeholder when serving the pages.
+func renderHeader() template.HTML {
+	headerPath := path.Join(UI_DIR, "header.html")
+	temp, err := template.New("header").Parse(readTemplateString(headerPath))
+	check(err)
+	var header strings.Builder
+	err = temp.Execute(&header, struct{ CSRFToken string }{CSRFToken: csrf.Placeholder})
+	check(err)
+	return template.HTML(header.String())
 }
 
 func main() {
 	err := os.MkdirAll(OUT_DIR, os.FileMode(0777))
 	check(err)
 
-	headerPath := path.Join(UI_DIR, "header.html")
-	header := template.HTML(readTemplateString(headerPath))
+	header := renderHeader()
 
 	home(header)
 	login(header)
 	register(header)
     verification(header)
+	email_change(header)
 	forgot_password(header)
 }
@@ -40,7 +40,9 @@ func main() {
         ctx, conn := conn()
         defer conn.Close(context.Background())
         migs := migrations.ListMigrations("migrations")
-        migrations.RunAll(conn, ctx, migs)
+        if err := migrations.RunAll(conn, ctx, migs); err != nil {
+            log.Fatal(err)
+        }
 	default:
 		fmt.Println("Unknown command:", command)
 	}
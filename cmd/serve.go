@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/oskarrrrrrr/sudoku-web/internal/api"
+	"github.com/oskarrrrrrr/sudoku-web/internal/csrf"
 	"github.com/oskarrrrrrr/sudoku-web/internal/migrations"
+	"github.com/oskarrrrrrr/sudoku-web/internal/oidc"
+	"github.com/oskarrrrrrr/sudoku-web/internal/passhash"
+	"github.com/oskarrrrrrr/sudoku-web/internal/passpolicy"
+	"github.com/oskarrrrrrr/sudoku-web/internal/ratelimit"
 	"github.com/oskarrrrrrr/sudoku-web/internal/sudoku"
+	"github.com/oskarrrrrrr/sudoku-web/internal/webauthn"
 )
 
 func check(err error) {
@@ -40,30 +49,128 @@ func (d HTMLDir) Open(name string) (http.File, error) {
 
 func main() {
 	ctx := context.Background()
-	conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+	// Requests are handled concurrently and a single connection can only run
+	// one query at a time, so everything goes through a pool. Transactions
+	// hold on to one of its connections until they end.
+	pool, err := pgxpool.New(ctx, os.Getenv("DATABASE_URL"))
 	if err != nil {
 		log.Fatalf("Unable to connect to database: %v\n", err)
 	}
-	defer conn.Close(context.Background())
+	defer pool.Close()
 
 	migs := migrations.ListMigrations("migrations")
-	migrations.RunAll(conn, ctx, migs)
+	migrationConn, err := pool.Acquire(ctx)
+	if err != nil {
+		log.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	err = migrations.RunAll(migrationConn.Conn(), ctx, migs)
+	migrationConn.Release()
+	if err != nil {
+		log.Fatalf("Unable to run migrations: %v\n", err)
+	}
+
+	api.SecureCookies = isProd()
+	if v := os.Getenv("PASSWORD_HASH"); v != "" {
+		passhash.Current, err = passhash.ParseParams(v)
+		check(err)
+	}
+	if v := os.Getenv("PASSWORD_VERIFY_MIN_TIME"); v != "" {
+		passhash.MinVerifyTime, err = time.ParseDuration(v)
+		check(err)
+	}
+	if v := os.Getenv("PASSWORD_MIN_LEN"); v != "" {
+		api.PasswordPolicy.MinLen, err = strconv.Atoi(v)
+		check(err)
+	}
+	if v := os.Getenv("PASSWORD_MAX_LEN"); v != "" {
+		api.PasswordPolicy.MaxLen, err = strconv.Atoi(v)
+		check(err)
+	}
+	if v := os.Getenv("PASSWORD_BANNED_FILE"); v != "" {
+		check(api.PasswordPolicy.AddBanned(v))
+	}
+	if v := os.Getenv("PASSWORD_BREACHED_FILE"); v != "" {
+		api.PasswordPolicy.Breached, err = passpolicy.OpenBreachedList(v)
+		check(err)
+	}
+	withUser := func(handler http.HandlerFunc) http.Handler {
+		return api.Authenticate(pool, ctx, handler)
+	}
+	loggedIn := func(handler http.HandlerFunc) http.Handler {
+		return api.Authenticate(pool, ctx, api.RequireUser(handler))
+	}
+	adminOnly := func(handler http.HandlerFunc) http.Handler {
+		return api.Authenticate(pool, ctx, api.RequireUser(api.RequireRole(api.RoleAdmin, handler)))
+	}
+	// withUserOrToken and loggedInOrToken also accept API tokens with the scope
+	withUserOrToken := func(scope api.Scope, handler http.HandlerFunc) http.Handler {
+		return api.AuthenticateWithScope(pool, ctx, scope, handler)
+	}
+	loggedInOrToken := func(scope api.Scope, handler http.HandlerFunc) http.Handler {
+		return api.AuthenticateWithScope(pool, ctx, scope, api.RequireUser(handler))
+	}
+
+	origins := []string{"https://www." + api.Domain, "https://" + api.Domain}
+	if !isProd() {
+		origins = []string{"http://localhost:9100"}
+	}
+	csrfConfig := csrf.Config{Origins: origins, Secure: isProd()}
 
 	fs := http.FileServer(HTMLDir{Dir: http.Dir("./static")})
-	http.Handle("/", fs)
+	http.Handle("/", csrfConfig.InjectToken(fs))
 
-	sudokus := sudoku.ReadSudokus()
-	http.HandleFunc(
-		"GET /api/random-sudoku",
-		func(w http.ResponseWriter, r *http.Request) {
-			sudoku.RandomSudoku(sudokus, w, r)
+	difficulties, err := sudoku.LoadDifficulties(pool, ctx)
+	check(err)
+	if len(difficulties) == 0 {
+		log.Fatal("No difficulties defined.")
+	}
+	sudokuList, err := sudoku.LoadSudokus("sudokus.txt")
+	check(err)
+	sudokus := sudoku.NewCorpus(sudokuList, difficulties)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			err := sudoku.ReloadCorpus(pool, ctx, sudokus, "sudokus.txt")
+			if err != nil {
+				log.Printf("ERR: Failed to reload sudokus: %v\n", err)
+			}
+		}
+	}()
+	poolCtx, stopPool := context.WithCancel(ctx)
+	poolDone, err := sudoku.ReplenishPool(
+		poolCtx, sudokus,
+		sudoku.PoolConfig{
+			MinUnserved:     10,
+			Interval:        time.Minute,
+			CPUBudget:       0.25,
+			GenerateTimeout: 5 * time.Minute,
+			OutFile:         "sudokus.txt",
 		},
 	)
+	check(err)
+
+	http.Handle(
+		"GET /api/random-sudoku",
+		withUserOrToken(api.ScopeSudokuRead, func(w http.ResponseWriter, r *http.Request) {
+			user, _ := api.UserFromContext(r.Context())
+			sudoku.RandomSudoku(pool, ctx, sudokus, user.Id, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/sudokus/finished",
+		loggedInOrToken(api.ScopeSudokuWrite, func(w http.ResponseWriter, r *http.Request) {
+			user, _ := api.UserFromContext(r.Context())
+			sudoku.FinishSudoku(pool, ctx, sudokus, user.Id, w, r)
+		}),
+	)
 
 	http.HandleFunc(
-		"POST /api/login",
+		"GET /api/difficulties",
 		func(w http.ResponseWriter, r *http.Request) {
-			api.Login(conn, ctx, w, r)
+			sudoku.ListDifficulties(sudokus, w, r)
 		},
 	)
 
@@ -76,11 +183,120 @@ func main() {
 		emailSender = api.GetPostmarkEmailSender("https://api.postmarkapp.com/email", postmarkToken)
 	}
 
-	http.HandleFunc(
+	var limiter ratelimit.Limiter = ratelimit.NewMemory()
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		limiter = ratelimit.NewPostgres(pool)
+	}
+	limited := func(rules []ratelimit.Rule, handler http.Handler) http.Handler {
+		return ratelimit.Middleware(limiter, rules, handler)
+	}
+	trustedProxies := 0
+	if v := os.Getenv("RATE_LIMIT_TRUST_PROXY"); v != "" {
+		trustedProxies, err = strconv.Atoi(v)
+		if err != nil || trustedProxies < 0 {
+			log.Fatalf("Invalid RATE_LIMIT_TRUST_PROXY: %q\n", v)
+		}
+	}
+	byIP := ratelimit.ByIP(trustedProxies)
+	byEmail := ratelimit.ByJSONField("email", ratelimit.EmailKey)
+	// the limit of a rule can be changed with RATE_LIMIT_<NAME>, e.g.
+	// RATE_LIMIT_LOGIN_IP=20/6s
+	rule := func(name string, key ratelimit.KeyFunc, limit ratelimit.Limit) ratelimit.Rule {
+		env := "RATE_LIMIT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if v := os.Getenv(env); v != "" {
+			var err error
+			limit, err = ratelimit.ParseLimit(v)
+			if err != nil {
+				log.Fatalf("Invalid %v: %v\n", env, err)
+			}
+		}
+		return ratelimit.Rule{Name: name, Key: key, Limit: limit}
+	}
+	loginLimits := []ratelimit.Rule{
+		rule("login-ip", byIP, ratelimit.Limit{Burst: 20, Every: 6 * time.Second}),
+		rule("login-email", byEmail, ratelimit.Limit{Burst: 10, Every: time.Minute}),
+	}
+	// limits of endpoints that send emails
+	emailLimits := []ratelimit.Rule{
+		rule("email-ip", byIP, ratelimit.Limit{Burst: 5, Every: 5 * time.Minute}),
+		rule("email-email", byEmail, ratelimit.Limit{Burst: 3, Every: 10 * time.Minute}),
+	}
+	verificationLimits := []ratelimit.Rule{
+		rule("verification-ip", byIP, ratelimit.Limit{Burst: 3, Every: 10 * time.Minute}),
+		rule("verification-email", byEmail, ratelimit.Limit{Burst: 2, Every: 15 * time.Minute}),
+	}
+	passwordLimits := []ratelimit.Rule{
+		rule("password-ip", byIP, ratelimit.Limit{Burst: 10, Every: time.Minute}),
+	}
+
+	http.Handle(
+		"POST /api/login",
+		limited(loginLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.Login(pool, ctx, emailSender, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/login/two-factor",
+		limited(loginLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.LoginTwoFactor(pool, ctx, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/logout",
+		withUser(func(w http.ResponseWriter, r *http.Request) {
+			api.Logout(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"GET /api/sessions",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.ListSessions(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"DELETE /api/sessions",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.DeleteOtherSessions(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"DELETE /api/sessions/{id}",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.DeleteSession(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
 		"POST /api/register",
-		func(w http.ResponseWriter, r *http.Request) {
-			api.CreateUser(conn, ctx, emailSender, !isProd(), w, r)
-		},
+		limited(emailLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.CreateUser(pool, ctx, emailSender, !isProd(), w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/verification/resend",
+		limited(verificationLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.ResendVerification(pool, ctx, emailSender, !isProd(), w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/password/forgot",
+		limited(emailLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.ForgotPassword(pool, ctx, emailSender, !isProd(), w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/password/reset",
+		limited(passwordLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.ResetPassword(pool, ctx, w, r)
+		})),
 	)
 
 	verification_succeeded_html, err := os.ReadFile("static/verification-succeeded.html")
@@ -88,19 +304,308 @@ func main() {
     verification_failed_html, err := os.ReadFile("static/verification-failed.html")
 	check(err)
 
-	http.HandleFunc(
+	http.Handle(
 		"GET /verify/{token}",
-		func(w http.ResponseWriter, r *http.Request) {
+		csrfConfig.InjectToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			api.VerifyUser(
-				conn, ctx,
+				pool, ctx,
 				verification_succeeded_html, verification_failed_html,
 				w, r,
 			)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/password/change",
+		limited(passwordLimits, loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.ChangePassword(pool, ctx, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/password/remove",
+		limited(passwordLimits, loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.RemovePassword(pool, ctx, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/email/change",
+		limited(emailLimits, loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.ChangeEmail(pool, ctx, emailSender, !isProd(), w, r)
+		})),
+	)
+
+	http.Handle(
+		"DELETE /api/account",
+		limited(passwordLimits, loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.DeleteAccount(pool, ctx, w, r)
+		})),
+	)
+
+	http.Handle(
+		"GET /api/account/export",
+		loggedInOrToken(api.ScopeAccountRead, func(w http.ResponseWriter, r *http.Request) {
+			api.ExportAccount(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/two-factor/totp/setup",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.SetupTOTP(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/two-factor/totp/enable",
+		limited(passwordLimits, loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.EnableTOTP(pool, ctx, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/two-factor/totp/disable",
+		limited(passwordLimits, loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.DisableTOTP(pool, ctx, w, r)
+		})),
+	)
+
+	http.Handle(
+		"GET /api/tokens",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.ListAPITokens(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/tokens",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.CreateAPIToken(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"DELETE /api/tokens/{id}",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.DeleteAPIToken(pool, ctx, w, r)
+		}),
+	)
+
+	email_change_succeeded_html, err := os.ReadFile("static/email-change-succeeded.html")
+	check(err)
+	email_change_failed_html, err := os.ReadFile("static/email-change-failed.html")
+	check(err)
+
+	http.Handle(
+		"GET /verify-email/{token}",
+		csrfConfig.InjectToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.ConfirmEmailChange(
+				pool, ctx,
+				email_change_succeeded_html, email_change_failed_html,
+				w, r,
+			)
+		})),
+	)
+
+	var oidcProviders []*oidc.Provider
+	if fileName := os.Getenv("OIDC_PROVIDERS_FILE"); fileName != "" {
+		configs, err := oidc.LoadConfigs(fileName)
+		check(err)
+		for _, config := range configs {
+			provider, err := oidc.NewProvider(ctx, config, nil)
+			check(err)
+			oidcProviders = append(oidcProviders, provider)
+		}
+	}
+	oidc_login_failed_html, err := os.ReadFile("static/oidc-login-failed.html")
+	check(err)
+
+	http.HandleFunc(
+		"GET /api/oidc/providers",
+		func(w http.ResponseWriter, r *http.Request) {
+			api.ListOIDCProviders(oidcProviders, w, r)
+		},
+	)
+
+	http.Handle(
+		"GET /login/oidc/{provider}",
+		limited(loginLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.OIDCLogin(pool, ctx, oidcProviders, w, r)
+		})),
+	)
+
+	http.Handle(
+		"GET /login/oidc/{provider}/callback",
+		csrfConfig.InjectToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.OIDCCallback(pool, ctx, oidcProviders, oidc_login_failed_html, w, r)
+		})),
+	)
+
+	login_link_html, err := os.ReadFile("static/login-link.html")
+	check(err)
+
+	http.Handle(
+		"POST /api/login/magic",
+		limited(emailLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.MagicLogin(pool, ctx, emailSender, !isProd(), w, r)
+		})),
+	)
+
+	http.Handle(
+		"GET /login/{token}",
+		csrfConfig.InjectToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.LoginLinkPage(login_link_html, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/login/link",
+		limited(loginLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.LoginWithLink(pool, ctx, w, r)
+		})),
+	)
+
+	relyingParty := webauthn.RelyingParty{
+		ID:      api.Domain,
+		Name:    "BoringSudoku",
+		Origins: origins,
+	}
+	if !isProd() {
+		relyingParty.ID = "localhost"
+	}
+
+	http.Handle(
+		"POST /api/login/passkey/begin",
+		limited(loginLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.BeginPasskeyLogin(pool, ctx, relyingParty, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/login/passkey/finish",
+		limited(loginLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			api.FinishPasskeyLogin(pool, ctx, relyingParty, w, r)
+		})),
+	)
+
+	http.Handle(
+		"GET /api/passkeys",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.ListPasskeys(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/passkeys/begin",
+		limited(passwordLimits, loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.BeginPasskeyRegistration(pool, ctx, relyingParty, w, r)
+		})),
+	)
+
+	http.Handle(
+		"POST /api/passkeys/finish",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.FinishPasskeyRegistration(pool, ctx, relyingParty, w, r)
+		}),
+	)
+
+	http.Handle(
+		"DELETE /api/passkeys/{id}",
+		loggedIn(func(w http.ResponseWriter, r *http.Request) {
+			api.DeletePasskey(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"GET /api/admin/users",
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			api.ListUsers(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/admin/users/{id}/verify",
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			api.AdminVerifyUser(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/admin/users/{id}/disable",
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			api.DisableUser(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/admin/users/{id}/enable",
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			api.EnableUser(pool, ctx, w, r)
+		}),
+	)
+
+	http.Handle(
+		"POST /api/admin/users/{id}/password-reset",
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			api.ForcePasswordReset(pool, ctx, emailSender, !isProd(), w, r)
+		}),
+	)
+
+	http.Handle(
+		"GET /api/admin/corpus",
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			api.CorpusStats(pool, ctx, sudokus, w, r)
+		}),
+	)
+
+	http.Handle(
+		"GET /api/admin/audit-log",
+		adminOnly(func(w http.ResponseWriter, r *http.Request) {
+			api.ListAuditLog(pool, ctx, w, r)
+		}),
+	)
+
+	unverifiedMaxAge := 7 * 24 * time.Hour
+	if v := os.Getenv("UNVERIFIED_USER_MAX_AGE"); v != "" {
+		unverifiedMaxAge, err = time.ParseDuration(v)
+		check(err)
+	}
+	cleanupCtx, stopCleanup := context.WithCancel(ctx)
+	cleanupDone := api.RunCleanup(
+		pool, cleanupCtx,
+		api.CleanupConfig{
+			Interval:         time.Hour,
+			UnverifiedMaxAge: unverifiedMaxAge,
 		},
 	)
 
-	log.Println("Server starting on port 9100...")
-	if err := http.ListenAndServe(":9100", nil); err != nil {
-		fmt.Println(err)
+	server := &http.Server{Addr: ":9100", Handler: csrfConfig.Protect(http.DefaultServeMux)}
+	go func() {
+		log.Println("Server starting on port 9100...")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println(err)
+	}
+	stopPool()
+	stopCleanup()
+	for _, done := range []<-chan struct{}{poolDone, cleanupDone} {
+		select {
+		case <-done:
+		case <-shutdownCtx.Done():
+			log.Println("Background jobs didn't stop in time.")
+			return
+		}
 	}
 }
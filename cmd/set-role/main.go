@@ -0,0 +1,73 @@
+// Sets the role of a user, e.g. to make the first admin:
+//
+//	go run ./cmd/set-role -email admin@example.com -role admin
+//
+// The change is recorded in the audit log without an actor.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/oskarrrrrrr/sudoku-web/internal/api"
+	"github.com/oskarrrrrrr/sudoku-web/internal/emailaddr"
+)
+
+var email = flag.String("email", "", "email of the user")
+var role = flag.String("role", string(api.RoleAdmin), "role to set: user or admin")
+
+func main() {
+	flag.Parse()
+
+	newRole := api.Role(*role)
+	if newRole != api.RoleUser && newRole != api.RoleAdmin {
+		log.Fatalf("Unknown role: %v\n", *role)
+	}
+	address, err := emailaddr.Normalize(*email)
+	if err != nil {
+		log.Fatalf("Invalid email: '%v'\n", *email)
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	defer conn.Close(context.Background())
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback(context.Background())
+
+	var userId int
+	var oldRole api.Role
+	err = tx.QueryRow(
+		ctx,
+		`UPDATE users u SET role = $2 FROM users old
+        WHERE u.id = old.id AND lower(u.email) = lower($1)
+        RETURNING u.id, old.role`,
+		address, newRole,
+	).Scan(&userId, &oldRole)
+	if errors.Is(err, pgx.ErrNoRows) {
+		log.Fatalf("No user with email '%v'\n", address)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	details := map[string]any{"from": oldRole, "to": newRole}
+	err = api.Audit(tx, ctx, nil, api.AuditSetRole, userId, details)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Role of '%v' changed from %v to %v\n", address, oldRole, newRole)
+}
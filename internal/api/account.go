@@ -0,0 +1,624 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const emailChangeTokenDuration = 30 * time.Minute
+
+// Accounts without a password confirm sensitive changes by having logged in
+// at most this long ago.
+const reauthMaxAge = 10 * time.Minute
+
+// reauthenticate confirms that the logged in user is present before a
+// sensitive change. A code from the authenticator app or a recovery code is
+// accepted when given. Otherwise users with a password have to enter it.
+// Users without one, created through OIDC or a login link, have nothing to
+// enter, so their session must have been created within reauthMaxAge, that is
+// they logged in again with the provider or a new link. It writes the error
+// response when it returns false.
+func reauthenticate(
+	conn *pgxpool.Pool, ctx context.Context, password, code string,
+	w http.ResponseWriter, r *http.Request,
+) bool {
+	user, _ := UserFromContext(r.Context())
+	sessionId, _ := sessionIdFromContext(r.Context())
+
+	var hash string
+	var sessionCreatedAt time.Time
+	err := conn.QueryRow(
+		ctx,
+		`SELECT u.password, s.created_at FROM users u
+        JOIN sessions s ON s.user_id = u.id
+        WHERE u.id = $1 AND s.id::text = $2`,
+		user.Id, sessionId,
+	).Scan(&hash, &sessionCreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Log in again to confirm it's you.", http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		internalErr(w, err)
+		return false
+	}
+
+	if code != "" {
+		ok, err := checkSecondFactor(conn, ctx, user.Id, code)
+		if err != nil {
+			internalErr(w, err)
+			return false
+		}
+		if !ok {
+			http.Error(w, "Invalid code.", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if hash == "" {
+		if time.Since(sessionCreatedAt) > reauthMaxAge {
+			http.Error(w, "Log in again to confirm it's you.", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if !checkPassword(hash, password) {
+		http.Error(w, "Wrong password.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// ChangePassword sets a new password of the logged in user and ends all other
+// sessions. Accounts without a password set their first one here, confirmed
+// as described in reauthenticate.
+func ChangePassword(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	sessionId, _ := sessionIdFromContext(r.Context())
+
+	var req changePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+	if !checkPasswordPolicy(w, req.NewPassword) {
+		return
+	}
+
+	if !reauthenticate(conn, ctx, req.CurrentPassword, "", w, r) {
+		return
+	}
+
+	pass, err := hashPassword(req.NewPassword)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(ctx, `UPDATE users SET password = $2 WHERE id = $1`, user.Id, pass)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	err = deleteUserSessions(tx, ctx, user.Id, sessionId)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loginMethods are the ways a user can log in without a link sent by email.
+type loginMethods struct {
+	password   bool
+	passkeys   int
+	identities int
+}
+
+func (m loginMethods) count() int {
+	n := m.passkeys + m.identities
+	if m.password {
+		n++
+	}
+	return n
+}
+
+// lockLoginMethods returns the login methods of the user and locks the user
+// until tx ends, so that two requests can't remove the last two at once.
+func lockLoginMethods(tx pgx.Tx, ctx context.Context, userId int) (loginMethods, error) {
+	var m loginMethods
+	err := tx.QueryRow(
+		ctx,
+		`SELECT password <> '',
+            (SELECT count(*) FROM passkeys WHERE user_id = $1),
+            (SELECT count(*) FROM user_identities WHERE user_id = $1)
+        FROM users WHERE id = $1 FOR UPDATE`,
+		userId,
+	).Scan(&m.password, &m.passkeys, &m.identities)
+	return m, err
+}
+
+type removePasswordRequest struct {
+	Password string `json:"password"`
+	// from the authenticator app or a recovery code, instead of the password
+	Code string `json:"code"`
+}
+
+// RemovePassword makes the logged in user log in with a passkey or an
+// identity provider instead of a password. The password can't be removed
+// when it's the only way to log in.
+func RemovePassword(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req removePasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+	if !reauthenticate(conn, ctx, req.Password, req.Code, w, r) {
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	methods, err := lockLoginMethods(tx, ctx, user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if !methods.password {
+		http.Error(w, "The account has no password.", http.StatusConflict)
+		return
+	}
+	if methods.count() == 1 {
+		http.Error(w, "Add a passkey before removing your password.", http.StatusConflict)
+		return
+	}
+	_, err = tx.Exec(ctx, `UPDATE users SET password = '' WHERE id = $1`, user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func SendEmailChangeEmail(ctx context.Context, sendEmail EmailSender, to, token string) error {
+	link := `https://www.` + Domain + `/verify-email/` + token
+	linkHtml := `<a href="` + link + `">` + link + `</a>`
+	email := Email{
+		From:          "verify-email@" + Domain,
+		To:            to,
+		Subject:       "Sudoku - Confirm New Email",
+		HtmlBody:      `Hi,<br><br>confirm your new email address using this link: ` + linkHtml + `<br><br>Best,<br>Oskar`,
+		MessageStream: MessageStreamOutbound,
+	}
+	return sendEmail(ctx, email)
+}
+
+func SendEmailChangeNotice(ctx context.Context, sendEmail EmailSender, to, newEmail string) error {
+	email := Email{
+		From:          "verify-email@" + Domain,
+		To:            to,
+		Subject:       "Sudoku - Email Change Requested",
+		HtmlBody:      `Hi,<br><br>a change of your account email to ` + newEmail + ` was requested. It will take effect once the new address is confirmed.<br><br>If it wasn't you, change your password.<br><br>Best,<br>Oskar`,
+		MessageStream: MessageStreamOutbound,
+	}
+	return sendEmail(ctx, email)
+}
+
+type changeEmailRequest struct {
+	NewEmail string `json:"newEmail"`
+	Password string `json:"password"`
+}
+
+// ChangeEmail sends a confirmation link to the new email and a notice to the
+// current one. The email is switched only after the link is clicked. The
+// password is required for accounts that have one, see reauthenticate.
+func ChangeEmail(
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender, debug bool,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req changeEmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	var ok bool
+	req.NewEmail, ok = normalizeEmail(w, req.NewEmail)
+	if !ok {
+		return
+	}
+
+	if !reauthenticate(conn, ctx, req.Password, "", w, r) {
+		return
+	}
+
+	var taken bool
+	err = conn.QueryRow(
+		ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))`, req.NewEmail,
+	).Scan(&taken)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	err = SendEmailChangeNotice(ctx, sendEmail, user.Email, req.NewEmail)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	// Don't reveal that the new email belongs to another account.
+	if taken {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	expires_at := time.Now().Add(emailChangeTokenDuration)
+	var token string
+	err = conn.QueryRow(
+		ctx,
+		`INSERT INTO email_change_tokens (user_id, new_email, expires_at) VALUES ($1, $2, $3)
+        ON CONFLICT (user_id) DO UPDATE
+            SET token = gen_random_uuid(),
+                new_email = $2,
+                expires_at = $3
+        RETURNING token`,
+		user.Id, req.NewEmail, expires_at,
+	).Scan(&token)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if debug {
+		log.Printf("Email change: '%v' -> '%v', token: %v\n", user.Email, req.NewEmail, token)
+	}
+
+	err = SendEmailChangeEmail(ctx, sendEmail, req.NewEmail, token)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ConfirmEmailChange switches the email of an account using a link sent to
+// the new email.
+func ConfirmEmailChange(
+	conn *pgxpool.Pool, ctx context.Context,
+	htmlOnSuccess, htmlOnFail []byte,
+	w http.ResponseWriter, r *http.Request,
+) {
+	token := r.PathValue("token")
+	err := uuid.Validate(token)
+	if err != nil {
+		w.Write(htmlOnFail)
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var expires_at time.Time
+	var user_id int
+	var new_email string
+	err = tx.QueryRow(
+		ctx,
+		`DELETE FROM email_change_tokens WHERE token = $1
+        RETURNING user_id, new_email, expires_at`,
+		token,
+	).Scan(&user_id, &new_email, &expires_at)
+
+	if err != nil || time.Now().After(expires_at) {
+		w.Write(htmlOnFail)
+		return
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET email = $2 WHERE id = $1`, user_id, new_email)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		// someone registered the email in the meantime
+		w.Write(htmlOnFail)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.Write(htmlOnSuccess)
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+// DeleteAccount removes the logged in user along with all of their data.
+// The password is required for accounts that have one, see reauthenticate.
+func DeleteAccount(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req deleteAccountRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	if !reauthenticate(conn, ctx, req.Password, "", w, r) {
+		return
+	}
+
+	// tokens, sessions and game data are removed by ON DELETE CASCADE
+	_, err = conn.Exec(ctx, `DELETE FROM users WHERE id = $1`, user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Some timestamps are nullable in the database, hence the pointers.
+type exportedUser struct {
+	Id               int        `json:"id"`
+	Email            string     `json:"email"`
+	Role             Role       `json:"role"`
+	Verified         bool       `json:"verified"`
+	TwoFactorEnabled bool       `json:"twoFactorEnabled"`
+	Disabled         bool       `json:"disabled"`
+	FailedLogins     int        `json:"failedLogins"`
+	LockedUntil      *time.Time `json:"lockedUntil"`
+	CreatedAt        *time.Time `json:"createdAt"`
+}
+
+type exportedToken struct {
+	CreatedAt *time.Time `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type exportedEmailChange struct {
+	NewEmail  string     `json:"newEmail"`
+	CreatedAt *time.Time `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type exportedSession struct {
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type exportedPlayedSudoku struct {
+	Sudoku     string     `json:"sudoku"`
+	ServedAt   time.Time  `json:"servedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+type exportedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportedPasskey struct {
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// Only when the codes were made and used, the hashes stay private.
+type exportedRecoveryCode struct {
+	CreatedAt time.Time  `json:"createdAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+}
+
+type exportedAPIToken struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type accountExport struct {
+	User                  exportedUser           `json:"user"`
+	Identities            []exportedIdentity     `json:"identities"`
+	Passkeys              []exportedPasskey      `json:"passkeys"`
+	RecoveryCodes         []exportedRecoveryCode `json:"recoveryCodes"`
+	APITokens             []exportedAPIToken     `json:"apiTokens"`
+	VerificationTokens    []exportedToken        `json:"verificationTokens"`
+	PasswordResetRequests []exportedToken        `json:"passwordResetRequests"`
+	LoginLinkRequests     []exportedToken        `json:"loginLinkRequests"`
+	EmailChangeRequests   []exportedEmailChange  `json:"emailChangeRequests"`
+	Sessions              []exportedSession      `json:"sessions"`
+	PlayedSudokus         []exportedPlayedSudoku `json:"playedSudokus"`
+	AuditLog              []auditLogEntry        `json:"auditLog"`
+}
+
+func queryAll[T any](conn *pgxpool.Pool, ctx context.Context, sql string, args ...any) ([]T, error) {
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[T])
+}
+
+// ExportAccount returns everything stored about the logged in user as JSON.
+func ExportAccount(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var export accountExport
+	err := conn.QueryRow(
+		ctx,
+		`SELECT id, email, role, verified, totp_enabled, disabled, failed_logins,
+            locked_until, created_at
+        FROM users WHERE id = $1`,
+		user.Id,
+	).Scan(
+		&export.User.Id, &export.User.Email, &export.User.Role, &export.User.Verified,
+		&export.User.TwoFactorEnabled, &export.User.Disabled, &export.User.FailedLogins,
+		&export.User.LockedUntil, &export.User.CreatedAt,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	export.Identities, err = queryAll[exportedIdentity](
+		conn, ctx,
+		`SELECT provider, subject, email, created_at FROM user_identities
+        WHERE user_id = $1 ORDER BY created_at`,
+		user.Id,
+	)
+	if err == nil {
+		export.Passkeys, err = queryAll[exportedPasskey](
+			conn, ctx,
+			`SELECT name, created_at, last_used_at FROM passkeys
+            WHERE user_id = $1 ORDER BY created_at`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.RecoveryCodes, err = queryAll[exportedRecoveryCode](
+			conn, ctx,
+			`SELECT created_at, used_at FROM recovery_codes
+            WHERE user_id = $1 ORDER BY created_at`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.APITokens, err = queryAll[exportedAPIToken](
+			conn, ctx,
+			`SELECT name, scopes, created_at, expires_at, last_used_at FROM api_tokens
+            WHERE user_id = $1 ORDER BY created_at`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.VerificationTokens, err = queryAll[exportedToken](
+			conn, ctx,
+			`SELECT created_at, expires_at FROM verification_tokens WHERE user_id = $1`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.PasswordResetRequests, err = queryAll[exportedToken](
+			conn, ctx,
+			`SELECT created_at, expires_at FROM password_reset_tokens WHERE user_id = $1`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.LoginLinkRequests, err = queryAll[exportedToken](
+			conn, ctx,
+			`SELECT created_at, expires_at FROM login_tokens WHERE user_id = $1`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.EmailChangeRequests, err = queryAll[exportedEmailChange](
+			conn, ctx,
+			`SELECT new_email, created_at, expires_at FROM email_change_tokens WHERE user_id = $1`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.Sessions, err = queryAll[exportedSession](
+			conn, ctx,
+			`SELECT user_agent, created_at, last_seen_at, expires_at FROM sessions
+            WHERE user_id = $1 ORDER BY created_at`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.PlayedSudokus, err = queryAll[exportedPlayedSudoku](
+			conn, ctx,
+			`SELECT sudoku, served_at, finished_at FROM played_sudokus
+            WHERE user_id = $1 ORDER BY served_at`,
+			user.Id,
+		)
+	}
+	if err == nil {
+		export.AuditLog, err = queryAll[auditLogEntry](
+			conn, ctx,
+			`SELECT id, actor_id, actor_email, action, target_user_id, details, created_at
+            FROM audit_log
+            WHERE actor_id = $1 OR target_user_id = $1 ORDER BY id`,
+			user.Id,
+		)
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJson)
+	w.Header().Set("Content-Disposition", `attachment; filename="boringsudoku-export.json"`)
+	json.NewEncoder(w).Encode(export)
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExportAccount(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	user := createTestUser(t, pool)
+	admin := createTestUser(t, pool)
+
+	_, err := pool.Exec(
+		ctx,
+		`UPDATE users SET failed_logins = 3, locked_until = now() + interval '1 minute'
+        WHERE id = $1`,
+		user.Id,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Exec(
+		ctx,
+		`INSERT INTO recovery_codes (user_id, code_hash, used_at)
+        VALUES ($1, '\x01', NULL), ($1, '\x02', now())`,
+		user.Id,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Audit(pool, ctx, &admin, AuditDisableUser, user.Id, nil)
+	if err == nil {
+		err = Audit(pool, ctx, &user, AuditListUsers, 0, nil)
+	}
+	if err == nil {
+		err = Audit(pool, ctx, &admin, AuditListUsers, 0, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, err := pool.Exec(
+			context.Background(),
+			`DELETE FROM audit_log WHERE actor_id = ANY($1) OR target_user_id = ANY($1)`,
+			[]int{user.Id, admin.Id},
+		)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	r := httptest.NewRequest("GET", "/api/account/export", nil)
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	w := httptest.NewRecorder()
+	ExportAccount(pool, ctx, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v: %v", w.Code, w.Body.String())
+	}
+
+	var export struct {
+		User          map[string]any   `json:"user"`
+		RecoveryCodes []map[string]any `json:"recoveryCodes"`
+		AuditLog      []auditLogEntry  `json:"auditLog"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"failedLogins", "lockedUntil", "disabled"} {
+		if _, ok := export.User[key]; !ok {
+			t.Errorf("user is missing %q: %v", key, export.User)
+		}
+	}
+	if got := export.User["failedLogins"]; got != 3.0 {
+		t.Errorf("failedLogins = %v, want 3", got)
+	}
+	if export.User["lockedUntil"] == nil {
+		t.Errorf("lockedUntil is not set")
+	}
+
+	if len(export.RecoveryCodes) != 2 {
+		t.Fatalf("got %v recovery codes, want 2", len(export.RecoveryCodes))
+	}
+	for _, code := range export.RecoveryCodes {
+		if len(code) != 2 || code["createdAt"] == nil {
+			t.Errorf("recovery code = %v, want only createdAt and usedAt", code)
+		}
+	}
+	if export.RecoveryCodes[0]["usedAt"] == nil && export.RecoveryCodes[1]["usedAt"] == nil {
+		t.Errorf("usedAt is not set on the used code")
+	}
+
+	// the admin's entry about the user and the user's own one, but not the
+	// admin's entry that doesn't mention the user
+	if len(export.AuditLog) != 2 {
+		t.Fatalf("got %v audit log entries, want 2: %+v", len(export.AuditLog), export.AuditLog)
+	}
+	if a := export.AuditLog[0]; a.Action != AuditDisableUser || *a.TargetUserId != user.Id {
+		t.Errorf("first entry = %+v, want %v of the user", a, AuditDisableUser)
+	}
+	if a := export.AuditLog[1]; a.Action != AuditListUsers || *a.ActorId != user.Id {
+		t.Errorf("second entry = %+v, want %v by the user", a, AuditListUsers)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	pool := testPool(t)
+	user := createTestUser(t, pool)
+	session := logInTestUser(t, pool, user)
+
+	// the account has no password, a recent login confirms it instead
+	w := serveAsUser(pool, session, "POST", `{"newPassword": "first correct horse"}`, ChangePassword)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("setting first password: status = %v: %v", w.Code, w.Body.String())
+	}
+
+	w = serveAsUser(
+		pool, session, "POST",
+		`{"currentPassword": "wrong", "newPassword": "second correct horse"}`, ChangePassword,
+	)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("wrong password: status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+	w = serveAsUser(
+		pool, session, "POST",
+		`{"currentPassword": "first correct horse", "newPassword": "second correct horse"}`, ChangePassword,
+	)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %v: %v", w.Code, w.Body.String())
+	}
+}
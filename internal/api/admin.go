@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oskarrrrrrr/sudoku-web/internal/sudoku"
+)
+
+// Admin endpoints have to be wrapped by RequireRole(RoleAdmin, ...). Every
+// one of them is recorded in the audit log.
+
+type adminUserInfo struct {
+	Id               int        `json:"id"`
+	Email            string     `json:"email"`
+	Role             Role       `json:"role"`
+	Verified         bool       `json:"verified"`
+	Disabled         bool       `json:"disabled"`
+	TwoFactorEnabled bool       `json:"twoFactorEnabled"`
+	CreatedAt        *time.Time `json:"createdAt"`
+}
+
+const adminUsersPageSize = 50
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// ListUsers lists users ordered by id, optionally only the ones with the "q"
+// query parameter in their email. The next page starts after the id given in
+// the "after" parameter.
+func ListUsers(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	admin, _ := UserFromContext(r.Context())
+	query := r.URL.Query()
+	search := strings.TrimSpace(query.Get("q"))
+	after := 0
+	if v := query.Get("after"); v != "" {
+		var err error
+		after, err = strconv.Atoi(v)
+		if err != nil {
+			parseErr(w)
+			return
+		}
+	}
+
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, email, role, verified, disabled, totp_enabled, created_at FROM users
+        WHERE id > $1 AND ($2 = '' OR lower(email) LIKE '%' || lower($2) || '%')
+        ORDER BY id LIMIT $3`,
+		after, escapeLike(search), adminUsersPageSize,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	users, err := pgx.CollectRows(rows, pgx.RowToStructByPos[adminUserInfo])
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	err = Audit(conn, ctx, &admin, AuditListUsers, 0, map[string]any{"q": search, "after": after})
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if users == nil {
+		users = []adminUserInfo{}
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(users)
+}
+
+func targetUserId(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return 0, false
+	}
+	return userId, true
+}
+
+// updateUser runs the query with the id of the target user as $1 and records
+// the action. Any other statements are run in the same transaction by after.
+func updateUser(
+	conn *pgxpool.Pool, ctx context.Context, action, query string,
+	after func(tx pgx.Tx, userId int) error,
+	w http.ResponseWriter, r *http.Request,
+) {
+	admin, _ := UserFromContext(r.Context())
+	userId, ok := targetUserId(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	ct, err := tx.Exec(ctx, query, userId)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if ct.RowsAffected() == 0 {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if after != nil {
+		err = after(tx, userId)
+	}
+	if err == nil {
+		err = Audit(tx, ctx, &admin, action, userId, nil)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminVerifyUser marks the email of a user as verified.
+func AdminVerifyUser(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	updateUser(
+		conn, ctx, AuditVerifyUser,
+		`UPDATE users SET verified = true WHERE id = $1`,
+		func(tx pgx.Tx, userId int) error {
+			_, err := tx.Exec(ctx, `DELETE FROM verification_tokens WHERE user_id = $1`, userId)
+			return err
+		},
+		w, r,
+	)
+}
+
+// DisableUser logs a user out everywhere and blocks logging in and the use
+// of API tokens until the account is enabled again.
+func DisableUser(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	admin, _ := UserFromContext(r.Context())
+	userId, ok := targetUserId(w, r)
+	if !ok {
+		return
+	}
+	if userId == admin.Id {
+		http.Error(w, "You can't disable your own account.", http.StatusConflict)
+		return
+	}
+	updateUser(
+		conn, ctx, AuditDisableUser,
+		`UPDATE users SET disabled = true WHERE id = $1`,
+		func(tx pgx.Tx, userId int) error {
+			return deleteUserSessions(tx, ctx, userId, "")
+		},
+		w, r,
+	)
+}
+
+// EnableUser reverts DisableUser.
+func EnableUser(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	updateUser(
+		conn, ctx, AuditEnableUser,
+		`UPDATE users SET disabled = false WHERE id = $1`,
+		nil,
+		w, r,
+	)
+}
+
+// ForcePasswordReset removes the password of a user, logs them out everywhere
+// and emails them a password reset link. Other login methods keep working.
+func ForcePasswordReset(
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender, debug bool,
+	w http.ResponseWriter, r *http.Request,
+) {
+	admin, _ := UserFromContext(r.Context())
+	userId, ok := targetUserId(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var email string
+	err = tx.QueryRow(
+		ctx, `UPDATE users SET password = '' WHERE id = $1 RETURNING email`, userId,
+	).Scan(&email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "User not found.", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = deleteUserSessions(tx, ctx, userId, "")
+	}
+	if err == nil {
+		err = Audit(tx, ctx, &admin, AuditForcePasswordReset, userId, nil)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	token, err := createPasswordResetToken(conn, ctx, userId)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if debug {
+		log.Printf("Forced password reset: '%v', token: %v\n", email, token)
+	}
+
+	sendInBackground(func(ctx context.Context) error {
+		return SendPasswordResetEmail(ctx, sendEmail, email, token)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type corpusStats struct {
+	// number of sudokus of each size
+	Sizes        map[int]int              `json:"sizes"`
+	Difficulties []sudoku.DifficultyStats `json:"difficulties"`
+}
+
+// CorpusStats returns the number of sudokus the server has to serve.
+func CorpusStats(
+	conn *pgxpool.Pool, ctx context.Context, corpus *sudoku.Corpus,
+	w http.ResponseWriter, r *http.Request,
+) {
+	admin, _ := UserFromContext(r.Context())
+	stats := corpusStats{Sizes: corpus.CountBySize(), Difficulties: corpus.Stats()}
+	if stats.Difficulties == nil {
+		stats.Difficulties = []sudoku.DifficultyStats{}
+	}
+
+	err := Audit(conn, ctx, &admin, AuditViewCorpusStats, 0, nil)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(stats)
+}
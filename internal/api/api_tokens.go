@@ -0,0 +1,224 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Scope limits what an API token can be used for. Routes have to allow a
+// scope explicitly with AuthenticateWithScope, all others reject tokens.
+type Scope string
+
+const (
+	ScopeSudokuRead  Scope = "sudoku:read"
+	ScopeSudokuWrite Scope = "sudoku:write"
+	ScopeAccountRead Scope = "account:read"
+)
+
+var scopes = []Scope{ScopeSudokuRead, ScopeSudokuWrite, ScopeAccountRead}
+
+// Tokens start with a fixed prefix so that leaked tokens are easy to find.
+const apiTokenPrefix = "bst_"
+
+const apiTokenNameMaxLen = 64
+const apiTokenMaxExpiryDays = 365
+const apiTokensPerUser = 20
+
+func authenticateToken(
+	conn *pgxpool.Pool, ctx context.Context, scope Scope, token string,
+	next http.Handler, w http.ResponseWriter, r *http.Request,
+) {
+	var user User
+	var tokenId string
+	var tokenScopes []string
+	var lastUsedAt *time.Time
+	err := conn.QueryRow(
+		ctx,
+		`SELECT t.id, t.scopes, t.last_used_at, u.id, u.email, u.role
+        FROM api_tokens t JOIN users u ON u.id = t.user_id
+        WHERE t.token_hash = $1 AND (t.expires_at IS NULL OR t.expires_at > now())
+            AND NOT u.disabled`,
+		hashToken(token),
+	).Scan(&tokenId, &tokenScopes, &lastUsedAt, &user.Id, &user.Email, &user.Role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Invalid or expired API token.", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if !slices.Contains(tokenScopes, string(scope)) {
+		http.Error(w, "API token is missing the "+string(scope)+" scope.", http.StatusForbidden)
+		return
+	}
+
+	if lastUsedAt == nil || time.Since(*lastUsedAt) > sessionLastSeenInterval {
+		_, err = conn.Exec(ctx, `UPDATE api_tokens SET last_used_at = now() WHERE id = $1`, tokenId)
+		if err != nil {
+			internalErr(w, err)
+			return
+		}
+	}
+
+	reqCtx := context.WithValue(r.Context(), userContextKey, user)
+	next.ServeHTTP(w, r.WithContext(reqCtx))
+}
+
+type createAPITokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// 0 for a token that doesn't expire.
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+type apiTokenInfo struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type createAPITokenResponse struct {
+	apiTokenInfo
+	// Only returned when the token is created, it is not stored.
+	Token string `json:"token"`
+}
+
+// CreateAPIToken creates an API token for the logged in user.
+func CreateAPIToken(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req createAPITokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > apiTokenNameMaxLen {
+		http.Error(w, "Invalid name.", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required.", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(scopes, Scope(scope)) {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > apiTokenMaxExpiryDays {
+		http.Error(w, "Invalid expiry.", http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	err = conn.QueryRow(
+		ctx, `SELECT count(*) FROM api_tokens WHERE user_id = $1`, user.Id,
+	).Scan(&count)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if count >= apiTokensPerUser {
+		http.Error(w, "Too many API tokens. Delete some first.", http.StatusConflict)
+		return
+	}
+
+	random, err := randomToken()
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	resp := createAPITokenResponse{Token: apiTokenPrefix + random}
+	resp.Name = req.Name
+	resp.Scopes = req.Scopes
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		resp.ExpiresAt = &expiresAt
+	}
+	err = conn.QueryRow(
+		ctx,
+		`INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`,
+		user.Id, req.Name, hashToken(resp.Token), req.Scopes, resp.ExpiresAt,
+	).Scan(&resp.Id, &resp.CreatedAt)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJson)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ListAPITokens lists API tokens of the logged in user, including expired ones.
+func ListAPITokens(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, name, scopes, created_at, expires_at, last_used_at FROM api_tokens
+        WHERE user_id = $1 ORDER BY created_at`,
+		user.Id,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	tokens, err := pgx.CollectRows(rows, pgx.RowToStructByPos[apiTokenInfo])
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// DeleteAPIToken revokes an API token of the logged in user.
+func DeleteAPIToken(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	tokenId := r.PathValue("id")
+	if uuid.Validate(tokenId) != nil {
+		http.Error(w, "API token not found.", http.StatusNotFound)
+		return
+	}
+	ct, err := conn.Exec(
+		ctx, `DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`, tokenId, user.Id,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if ct.RowsAffected() == 0 {
+		http.Error(w, "API token not found.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func createTestToken(t *testing.T, pool *pgxpool.Pool, user User, scopes ...Scope) string {
+	t.Helper()
+	token := apiTokenPrefix + uuid.NewString()
+	_, err := pool.Exec(
+		context.Background(),
+		`INSERT INTO api_tokens (user_id, name, token_hash, scopes) VALUES ($1, 'test', $2, $3)`,
+		user.Id, hashToken(token), scopes,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenScopes(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	user := createTestUser(t, pool)
+
+	handler := AuthenticateWithScope(
+		pool, ctx, ScopeSudokuWrite,
+		RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ := UserFromContext(r.Context())
+			if got.Id != user.Id {
+				t.Errorf("user = %v, want %v", got.Id, user.Id)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})),
+	)
+
+	tests := []struct {
+		name   string
+		scopes []Scope
+		want   int
+	}{
+		{"with scope", []Scope{ScopeSudokuRead, ScopeSudokuWrite}, http.StatusNoContent},
+		{"without scope", []Scope{ScopeSudokuRead, ScopeAccountRead}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := createTestToken(t, pool, user, tt.scopes...)
+			r := httptest.NewRequest("POST", "/api/sudokus/finished", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v: %v", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditListUsers          = "list_users"
+	AuditVerifyUser         = "verify_user"
+	AuditDisableUser        = "disable_user"
+	AuditEnableUser         = "enable_user"
+	AuditForcePasswordReset = "force_password_reset"
+	AuditSetRole            = "set_role"
+	AuditViewCorpusStats    = "view_corpus_stats"
+	AuditViewAuditLog       = "view_audit_log"
+)
+
+// Audit records an action done by an admin, or from the command line when
+// actor is nil. targetUserId is 0 if the action is not about a single user.
+func Audit(
+	conn executor, ctx context.Context,
+	actor *User, action string, targetUserId int, details map[string]any,
+) error {
+	if details == nil {
+		details = map[string]any{}
+	}
+	detailsJson, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	var actorId *int
+	var actorEmail *string
+	if actor != nil {
+		actorId, actorEmail = &actor.Id, &actor.Email
+	}
+	var target *int
+	if targetUserId != 0 {
+		target = &targetUserId
+	}
+	_, err = conn.Exec(
+		ctx,
+		`INSERT INTO audit_log (actor_id, actor_email, action, target_user_id, details)
+        VALUES ($1, $2, $3, $4, $5::jsonb)`,
+		actorId, actorEmail, action, target, string(detailsJson),
+	)
+	return err
+}
+
+type auditLogEntry struct {
+	Id           int64           `json:"id"`
+	ActorId      *int            `json:"actorId"`
+	ActorEmail   *string         `json:"actorEmail"`
+	Action       string          `json:"action"`
+	TargetUserId *int            `json:"targetUserId"`
+	Details      json.RawMessage `json:"details"`
+	CreatedAt    time.Time       `json:"createdAt"`
+}
+
+const auditLogPageSize = 100
+
+// ListAuditLog returns the newest entries of the audit log, optionally only
+// the ones about the user given by the "user" query parameter. Older entries
+// are paged with the "before" parameter set to the id of the last entry seen.
+func ListAuditLog(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	admin, _ := UserFromContext(r.Context())
+	query := r.URL.Query()
+
+	var targetUserId *int
+	if v := query.Get("user"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			parseErr(w)
+			return
+		}
+		targetUserId = &id
+	}
+	var before *int64
+	if v := query.Get("before"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			parseErr(w)
+			return
+		}
+		before = &id
+	}
+
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, actor_id, actor_email, action, target_user_id, details, created_at
+        FROM audit_log
+        WHERE ($1::integer IS NULL OR target_user_id = $1)
+            AND ($2::bigint IS NULL OR id < $2)
+        ORDER BY id DESC LIMIT $3`,
+		targetUserId, before, auditLogPageSize,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	entries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[auditLogEntry])
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	details := map[string]any{}
+	if targetUserId != nil {
+		details["user"] = *targetUserId
+	}
+	if before != nil {
+		details["before"] = *before
+	}
+	err = Audit(conn, ctx, &admin, AuditViewAuditLog, 0, details)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if entries == nil {
+		entries = []auditLogEntry{}
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(entries)
+}
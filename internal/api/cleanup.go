@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type CleanupConfig struct {
+	// How often the cleanup runs.
+	Interval time.Duration
+	// Unverified users are deleted once their account is older than this,
+	// unless they still have a valid verification token.
+	UnverifiedMaxAge time.Duration
+}
+
+// RunCleanup periodically deletes expired tokens and sessions as well as stale
+// unverified users, which would otherwise hold on to their email forever.
+// It stops when ctx is cancelled and closes the returned channel once done.
+func RunCleanup(conn *pgxpool.Pool, ctx context.Context, config CleanupConfig) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			if err := cleanup(conn, ctx, config); err != nil && ctx.Err() == nil {
+				log.Printf("ERR: Cleanup failed: %v\n", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
+
+func cleanup(conn *pgxpool.Pool, ctx context.Context, config CleanupConfig) error {
+	steps := []struct {
+		name  string
+		query string
+		args  []any
+	}{
+		{
+			"expired verification tokens",
+			`DELETE FROM verification_tokens WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"expired password reset tokens",
+			`DELETE FROM password_reset_tokens WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"expired login tokens",
+			`DELETE FROM login_tokens WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"expired email change tokens",
+			`DELETE FROM email_change_tokens WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"expired OIDC login states",
+			`DELETE FROM oidc_login_states WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"expired login challenges",
+			`DELETE FROM login_challenges WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"expired WebAuthn challenges",
+			`DELETE FROM webauthn_challenges WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"expired sessions",
+			`DELETE FROM sessions WHERE expires_at < now()`,
+			nil,
+		},
+		{
+			"stale unverified users",
+			`DELETE FROM users u
+            WHERE NOT u.verified AND u.created_at < $1
+                AND NOT EXISTS (
+                    SELECT 1 FROM verification_tokens t
+                    WHERE t.user_id = u.id AND t.expires_at >= now()
+                )`,
+			[]any{time.Now().Add(-config.UnverifiedMaxAge)},
+		},
+	}
+	for _, step := range steps {
+		ct, err := conn.Exec(ctx, step.query, step.args...)
+		if err != nil {
+			return err
+		}
+		if ct.RowsAffected() > 0 {
+			log.Printf("Cleanup: deleted %v %v\n", ct.RowsAffected(), step.name)
+		}
+	}
+	return nil
+}
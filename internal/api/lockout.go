@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Number of failed logins in a row after which an account gets locked.
+const LOCKOUT_THRESHOLD = 5
+
+const lockoutBase = time.Minute
+const lockoutMax = 24 * time.Hour
+
+// lockDuration doubles with every failed login past the threshold.
+func lockDuration(failedLogins int) time.Duration {
+	d := lockoutBase
+	for i := LOCKOUT_THRESHOLD; i < failedLogins && d < lockoutMax; i++ {
+		d *= 2
+	}
+	return min(d, lockoutMax)
+}
+
+func SendAccountLockedEmail(ctx context.Context, sendEmail EmailSender, to string, lockedFor time.Duration) error {
+	link := `https://www.` + Domain + `/forgot-password`
+	linkHtml := `<a href="` + link + `">` + link + `</a>`
+	email := Email{
+		From:          "security@" + Domain,
+		To:            to,
+		Subject:       "Sudoku - Account Locked",
+		HtmlBody:      `Hi,<br><br>there were too many failed attempts to log in to your account, so it is locked for ` + lockedFor.String() + `. Failing to log in again after that locks it for longer.<br><br>If it wasn't you, consider resetting your password: ` + linkHtml + `<br><br>Best,<br>Oskar`,
+		MessageStream: MessageStreamOutbound,
+	}
+	return sendEmail(ctx, email)
+}
+
+// recordFailedLogin counts the failed login and locks the account once the
+// threshold is reached. The user is notified when the account gets locked.
+func recordFailedLogin(
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender, userId int, email string,
+) error {
+	var failedLogins int
+	err := conn.QueryRow(
+		ctx,
+		`UPDATE users SET failed_logins = failed_logins + 1 WHERE id = $1
+        RETURNING failed_logins`,
+		userId,
+	).Scan(&failedLogins)
+	if err != nil || failedLogins < LOCKOUT_THRESHOLD {
+		return err
+	}
+
+	lockedFor := lockDuration(failedLogins)
+	_, err = conn.Exec(
+		ctx,
+		`UPDATE users SET locked_until = $2 WHERE id = $1`,
+		userId, time.Now().Add(lockedFor),
+	)
+	if err != nil {
+		return err
+	}
+	if failedLogins == LOCKOUT_THRESHOLD {
+		sendInBackground(func(ctx context.Context) error {
+			return SendAccountLockedEmail(ctx, sendEmail, email, lockedFor)
+		})
+	}
+	return nil
+}
+
+// clearFailedLogins unlocks the account and resets the failed logins counter.
+func clearFailedLogins(conn executor, ctx context.Context, userId int) error {
+	_, err := conn.Exec(
+		ctx,
+		`UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1`,
+		userId,
+	)
+	return err
+}
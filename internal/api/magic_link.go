@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const loginTokenDuration = 15 * time.Minute
+
+// The browser that asked for a login link gets a secret in this cookie, the
+// link only works together with it. Otherwise someone could get a victim to
+// log in to the attacker's account by sending them a link.
+const loginLinkCookieName = "login_link"
+const loginLinkCookiePath = "/api/login/link"
+
+func SendLoginLinkEmail(ctx context.Context, sendEmail EmailSender, to, token string) error {
+	link := `https://www.` + Domain + `/login/` + token
+	linkHtml := `<a href="` + link + `">` + link + `</a>`
+	email := Email{
+		From:          "login@" + Domain,
+		To:            to,
+		Subject:       "Sudoku - Log In",
+		HtmlBody:      `Hi,<br><br>here is your login link: ` + linkHtml + `<br><br>It works once and expires in 15 minutes. If you didn't ask for it, you can ignore this email.<br><br>Best,<br>Oskar`,
+		MessageStream: MessageStreamOutbound,
+	}
+	return sendEmail(ctx, email)
+}
+
+func createLoginToken(
+	conn *pgxpool.Pool, ctx context.Context, userId int, browserSecret string, expiresAt time.Time,
+) (string, error) {
+	var token string
+	err := conn.QueryRow(
+		ctx,
+		`INSERT INTO login_tokens (user_id, expires_at, browser_hash) VALUES ($1, $2, $3)
+        ON CONFLICT (user_id) DO UPDATE
+            SET token = gen_random_uuid(),
+                expires_at = $2,
+                browser_hash = $3
+        RETURNING token`,
+		userId, expiresAt, hashToken(browserSecret),
+	).Scan(&token)
+	return token, err
+}
+
+func setLoginLinkCookie(w http.ResponseWriter, value string, expiresAt time.Time) {
+	cookie := &http.Cookie{
+		Name:     loginLinkCookieName,
+		Value:    value,
+		Path:     loginLinkCookiePath,
+		Expires:  expiresAt,
+		Secure:   SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	if value == "" {
+		cookie.Expires = time.Time{}
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+type magicLoginRequest struct {
+	Email string `json:"email"`
+}
+
+// MagicLogin emails a single use login link that works only in the browser
+// that asked for it. The response is the same whether the email is
+// registered or not.
+func MagicLogin(
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender, debug bool,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req magicLoginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	var ok bool
+	req.Email, ok = normalizeEmail(w, req.Email)
+	if !ok {
+		return
+	}
+
+	// set for unknown emails too, so that the cookie doesn't tell them apart
+	browserSecret, err := randomToken()
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	expiresAt := time.Now().Add(loginTokenDuration)
+
+	var userId int
+	err = conn.QueryRow(
+		ctx, `SELECT id FROM users WHERE lower(email) = lower($1)`, req.Email,
+	).Scan(&userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		setLoginLinkCookie(w, browserSecret, expiresAt)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	token, err := createLoginToken(conn, ctx, userId, browserSecret, expiresAt)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if debug {
+		log.Printf("Login link: '%v', token: %v\n", req.Email, token)
+	}
+
+	sendInBackground(func(ctx context.Context) error {
+		return SendLoginLinkEmail(ctx, sendEmail, req.Email, token)
+	})
+	setLoginLinkCookie(w, browserSecret, expiresAt)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginLinkPage shows the page a link sent by MagicLogin opens. The page asks
+// to confirm the login and sends the token to LoginWithLink, the link alone
+// doesn't use it up since email scanners and previews open links too.
+func LoginLinkPage(html []byte, w http.ResponseWriter, r *http.Request) {
+	// the token is in the URL
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(html)
+}
+
+type loginWithLinkRequest struct {
+	Token string `json:"token"`
+}
+
+// LoginWithLink logs in with the token of a link sent by MagicLogin, from the
+// browser that asked for the link. The link also verifies the email, since
+// only its owner could have received it.
+func LoginWithLink(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req loginWithLinkRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+	if uuid.Validate(req.Token) != nil {
+		http.Error(w, "Invalid or expired link.", http.StatusBadRequest)
+		return
+	}
+	cookie, err := r.Cookie(loginLinkCookieName)
+	if err != nil {
+		http.Error(w, "Open the link in the browser you asked for it in.", http.StatusForbidden)
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var expires_at time.Time
+	var userId int
+	var browserHash []byte
+	err = tx.QueryRow(
+		ctx,
+		`SELECT user_id, expires_at, browser_hash FROM login_tokens WHERE token = $1 FOR UPDATE`,
+		req.Token,
+	).Scan(&userId, &expires_at, &browserHash)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && time.Now().After(expires_at)) {
+		http.Error(w, "Invalid or expired link.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	// The token is kept, so that a link opened in the wrong browser can still
+	// be opened in the right one.
+	if subtle.ConstantTimeCompare(browserHash, hashToken(cookie.Value)) != 1 {
+		http.Error(w, "Open the link in the browser you asked for it in.", http.StatusForbidden)
+		return
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM login_tokens WHERE token = $1`, req.Token)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	// Same as with OIDC, whoever registered an unverified account didn't
+	// prove they own the email, so their password must not give access to it.
+	ct, err := tx.Exec(
+		ctx, `UPDATE users SET verified = true, password = '' WHERE id = $1 AND NOT verified`, userId,
+	)
+	if err == nil && ct.RowsAffected() == 1 {
+		_, err = tx.Exec(ctx, `DELETE FROM verification_tokens WHERE user_id = $1`, userId)
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		internalErr(w, err)
+		return
+	}
+	setLoginLinkCookie(w, "", time.Time{})
+
+	challenge, err := logIn(conn, ctx, w, r, userId)
+	if err != nil {
+		loginErr(w, err)
+		return
+	}
+	if challenge != "" {
+		writeLoginChallenge(w, challenge)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
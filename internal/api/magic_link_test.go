@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var loginLinkRe = regexp.MustCompile(`/login/([0-9a-f-]{36})`)
+
+// requestLoginLink asks for a login link for the user and returns its token
+// and the cookie set for the browser.
+func requestLoginLink(t *testing.T, pool *pgxpool.Pool, user User) (string, *http.Cookie) {
+	t.Helper()
+	emails := make(chan Email, 1)
+	sendEmail := func(_ context.Context, email Email) error {
+		emails <- email
+		return nil
+	}
+
+	r := httptest.NewRequest("POST", "/api/login/magic", strings.NewReader(`{"email": "`+user.Email+`"}`))
+	w := httptest.NewRecorder()
+	MagicLogin(pool, context.Background(), sendEmail, false, w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %v: %v", w.Code, w.Body.String())
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == loginLinkCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value == "" {
+		t.Fatal("no login link cookie")
+	}
+
+	select {
+	case email := <-emails:
+		match := loginLinkRe.FindStringSubmatch(email.HtmlBody)
+		if match == nil {
+			t.Fatalf("no link in %q", email.HtmlBody)
+		}
+		return match[1], cookie
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email sent")
+	}
+	return "", nil
+}
+
+func loginWithLink(pool *pgxpool.Pool, token string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/login/link", strings.NewReader(`{"token": "`+token+`"}`))
+	if cookie != nil {
+		r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	w := httptest.NewRecorder()
+	LoginWithLink(pool, context.Background(), w, r)
+	return w
+}
+
+func TestLoginWithLink(t *testing.T) {
+	pool := testPool(t)
+	user := createTestUser(t, pool)
+	token, cookie := requestLoginLink(t, pool, user)
+
+	if w := loginWithLink(pool, token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("without cookie: status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+	other := &http.Cookie{Name: loginLinkCookieName, Value: "other"}
+	if w := loginWithLink(pool, token, other); w.Code != http.StatusForbidden {
+		t.Errorf("with another cookie: status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	w := loginWithLink(pool, token, cookie)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %v, want %v: %v", w.Code, http.StatusNoContent, w.Body.String())
+	}
+	loggedIn := false
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookieName && c.Value != "" {
+			loggedIn = true
+		}
+	}
+	if !loggedIn {
+		t.Error("no session cookie")
+	}
+
+	if w := loginWithLink(pool, token, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("second use: status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
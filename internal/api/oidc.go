@@ -0,0 +1,248 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oskarrrrrrr/sudoku-web/internal/emailaddr"
+	"github.com/oskarrrrrrr/sudoku-web/internal/oidc"
+)
+
+const oidcStateCookieName = "oidc_state"
+
+// How long the user has to log in with the provider.
+const oidcLoginDuration = 10 * time.Minute
+
+type oidcProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// ListOIDCProviders lists identity providers that can be used to log in.
+func ListOIDCProviders(providers []*oidc.Provider, w http.ResponseWriter, r *http.Request) {
+	infos := make([]oidcProviderInfo, 0, len(providers))
+	for _, p := range providers {
+		name := p.DisplayName
+		if name == "" {
+			name = p.Name
+		}
+		infos = append(infos, oidcProviderInfo{Name: p.Name, DisplayName: name})
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(infos)
+}
+
+func findProvider(providers []*oidc.Provider, name string) *oidc.Provider {
+	for _, p := range providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// OIDCLogin redirects the user to the identity provider to log in.
+func OIDCLogin(
+	conn *pgxpool.Pool, ctx context.Context, providers []*oidc.Provider,
+	w http.ResponseWriter, r *http.Request,
+) {
+	provider := findProvider(providers, r.PathValue("provider"))
+	if provider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := oidc.NewLoginState()
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	expiresAt := time.Now().Add(oidcLoginDuration)
+	_, err = conn.Exec(
+		ctx,
+		`INSERT INTO oidc_login_states (state, provider, nonce, code_verifier, expires_at)
+        VALUES ($1, $2, $3, $4, $5)`,
+		state.State, provider.Name, state.Nonce, state.CodeVerifier, expiresAt,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	// The state is also kept in a cookie so that the callback only works in
+	// the browser that started the login. Otherwise someone could make a victim
+	// log in to the attacker's account.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state.State,
+		Path:     "/login/oidc/",
+		Expires:  expiresAt,
+		Secure:   SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.AuthURL(state), http.StatusFound)
+}
+
+var errOIDCEmailNotVerified = errors.New("identity provider didn't verify the email")
+
+// OIDCCallback finishes a login started by OIDCLogin and logs the user in.
+func OIDCCallback(
+	conn *pgxpool.Pool, ctx context.Context, providers []*oidc.Provider,
+	htmlOnFail []byte,
+	w http.ResponseWriter, r *http.Request,
+) {
+	fail := func(reason any) {
+		log.Printf("OIDC login failed: %v\n", reason)
+		w.Write(htmlOnFail)
+	}
+
+	provider := findProvider(providers, r.PathValue("provider"))
+	if provider == nil {
+		http.NotFound(w, r)
+		return
+	}
+	stateValue, err := oidc.CallbackState(r, oidcStateCookieName)
+	if err != nil {
+		fail(err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    "",
+		Path:     "/login/oidc/",
+		MaxAge:   -1,
+		Secure:   SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	state := oidc.LoginState{State: stateValue}
+	var providerName string
+	var expiresAt time.Time
+	err = conn.QueryRow(
+		ctx,
+		`DELETE FROM oidc_login_states WHERE state = $1
+        RETURNING provider, nonce, code_verifier, expires_at`,
+		stateValue,
+	).Scan(&providerName, &state.Nonce, &state.CodeVerifier, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		fail("unknown state")
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if providerName != provider.Name || time.Now().After(expiresAt) {
+		fail("state expired or issued for another provider")
+		return
+	}
+
+	exchangeCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	identity, err := provider.Exchange(exchangeCtx, r.URL.Query().Get("code"), state)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	userId, err := linkIdentity(conn, ctx, provider.Name, identity)
+	if errors.Is(err, errOIDCEmailNotVerified) || errors.Is(err, emailaddr.ErrInvalid) {
+		fail(err)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	challenge, err := logIn(conn, ctx, w, r, userId)
+	if errors.Is(err, errAccountDisabled) {
+		fail(err)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if challenge != "" {
+		// The fragment is not sent to the server nor in the Referer header.
+		http.Redirect(w, r, "/two-factor#"+challenge, http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// linkIdentity returns the user linked to the identity. A new identity is
+// linked to the user with the same email, which is created if needed.
+// Users created this way have no password, they can set one with the
+// forgot password flow.
+func linkIdentity(
+	conn *pgxpool.Pool, ctx context.Context, provider string, identity oidc.Identity,
+) (int, error) {
+	var userId int
+	err := conn.QueryRow(
+		ctx,
+		`SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`,
+		provider, identity.Subject,
+	).Scan(&userId)
+	if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+		return userId, err
+	}
+
+	// Only an email verified by the provider proves that the user owns it.
+	if identity.Email == "" || !identity.EmailVerified {
+		return 0, errOIDCEmailNotVerified
+	}
+	email, err := emailaddr.Normalize(identity.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var verified bool
+	err = tx.QueryRow(
+		ctx, `SELECT id, verified FROM users WHERE lower(email) = lower($1) FOR UPDATE`, email,
+	).Scan(&userId, &verified)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = tx.QueryRow(
+			ctx,
+			`INSERT INTO users (email, password, verified) VALUES ($1, '', true) RETURNING id`,
+			email,
+		).Scan(&userId)
+	} else if err == nil && !verified {
+		// Whoever registered the unverified account didn't prove they own the
+		// email, so their password must not give access to it.
+		_, err = tx.Exec(
+			ctx, `UPDATE users SET verified = true, password = '' WHERE id = $1`, userId,
+		)
+		if err == nil {
+			_, err = tx.Exec(ctx, `DELETE FROM verification_tokens WHERE user_id = $1`, userId)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO user_identities (provider, subject, user_id, email) VALUES ($1, $2, $3, $4)`,
+		provider, identity.Subject, userId, email,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return userId, tx.Commit(ctx)
+}
@@ -0,0 +1,470 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oskarrrrrrr/sudoku-web/internal/webauthn"
+)
+
+// How long the browser has to finish a passkey registration or login.
+const webauthnChallengeDuration = 5 * time.Minute
+
+const passkeyNameMaxLen = 64
+
+// base64URL is binary data sent to and from the browser, which decodes it
+// before passing it to the WebAuthn API.
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// The WebAuthn user handle of a user. It mustn't contain personal data so the
+// email can't be used.
+func userHandle(userId int) []byte {
+	return []byte(strconv.Itoa(userId))
+}
+
+func createWebauthnChallenge(conn *pgxpool.Pool, ctx context.Context, userId *int) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Exec(
+		ctx,
+		`INSERT INTO webauthn_challenges (challenge, user_id, expires_at) VALUES ($1, $2, $3)`,
+		challenge, userId, time.Now().Add(webauthnChallengeDuration),
+	)
+	return challenge, err
+}
+
+// consumeWebauthnChallenge deletes the challenge signed in clientDataJSON so it
+// can't be used again. It returns false when the challenge is unknown,
+// expired or was issued for a different user.
+func consumeWebauthnChallenge(
+	conn *pgxpool.Pool, ctx context.Context, clientDataJSON []byte, userId *int,
+) ([]byte, bool, error) {
+	challenge, err := webauthn.ChallengeFromClientData(clientDataJSON)
+	if err != nil {
+		return nil, false, nil
+	}
+	var owner *int
+	var expiresAt time.Time
+	err = conn.QueryRow(
+		ctx,
+		`DELETE FROM webauthn_challenges WHERE challenge = $1 RETURNING user_id, expires_at`,
+		challenge,
+	).Scan(&owner, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if time.Now().After(expiresAt) {
+		return nil, false, nil
+	}
+	sameUser := (owner == nil && userId == nil) ||
+		(owner != nil && userId != nil && *owner == *userId)
+	return challenge, sameUser, nil
+}
+
+type relyingPartyEntity struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	Id          base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string    `json:"type"`
+	Id   base64URL `json:"id"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// passkeyRegistrationOptions are PublicKeyCredentialCreationOptions for
+// navigator.credentials.create.
+type passkeyRegistrationOptions struct {
+	Challenge              base64URL              `json:"challenge"`
+	RP                     relyingPartyEntity     `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	Attestation            string                 `json:"attestation"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+}
+
+type beginPasskeyRegistrationRequest struct {
+	Password string `json:"password"`
+	// from the authenticator app or a recovery code, instead of the password
+	Code string `json:"code"`
+}
+
+// BeginPasskeyRegistration returns options for creating a passkey for the
+// logged in user. A passkey gives access to the account on its own, so the
+// user has to confirm it's them first, see reauthenticate.
+func BeginPasskeyRegistration(
+	conn *pgxpool.Pool, ctx context.Context, rp webauthn.RelyingParty,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req beginPasskeyRegistrationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+	if !reauthenticate(conn, ctx, req.Password, req.Code, w, r) {
+		return
+	}
+
+	rows, err := conn.Query(ctx, `SELECT id FROM passkeys WHERE user_id = $1`, user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	existing, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (credentialDescriptor, error) {
+		c := credentialDescriptor{Type: "public-key"}
+		err := row.Scan((*[]byte)(&c.Id))
+		return c, err
+	})
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	challenge, err := createWebauthnChallenge(conn, ctx, &user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(passkeyRegistrationOptions{
+		Challenge: challenge,
+		RP:        relyingPartyEntity{Id: rp.ID, Name: rp.Name},
+		User: userEntity{
+			Id:          userHandle(user.Id),
+			Name:        user.Email,
+			DisplayName: user.Email,
+		},
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: webauthn.AlgES256},
+			{Type: "public-key", Alg: webauthn.AlgRS256},
+		},
+		Timeout:     webauthnChallengeDuration.Milliseconds(),
+		Attestation: "none",
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "required",
+		},
+		ExcludeCredentials: existing,
+	})
+}
+
+type finishPasskeyRegistrationRequest struct {
+	Name              string    `json:"name"`
+	ClientDataJSON    base64URL `json:"clientDataJSON"`
+	AttestationObject base64URL `json:"attestationObject"`
+}
+
+type passkeyInfo struct {
+	Id         base64URL  `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// FinishPasskeyRegistration verifies and stores a passkey created with the
+// options from BeginPasskeyRegistration.
+func FinishPasskeyRegistration(
+	conn *pgxpool.Pool, ctx context.Context, rp webauthn.RelyingParty,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req finishPasskeyRegistrationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+	if len(req.Name) > passkeyNameMaxLen {
+		http.Error(w, "Name too long.", http.StatusBadRequest)
+		return
+	}
+
+	challenge, ok, err := consumeWebauthnChallenge(conn, ctx, req.ClientDataJSON, &user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired challenge.", http.StatusBadRequest)
+		return
+	}
+
+	credential, err := rp.VerifyRegistration(challenge, req.ClientDataJSON, req.AttestationObject)
+	if err != nil {
+		log.Printf("Passkey registration failed: %v\n", err)
+		http.Error(w, "Invalid passkey.", http.StatusBadRequest)
+		return
+	}
+
+	info := passkeyInfo{Id: credential.Id, Name: req.Name}
+	err = conn.QueryRow(
+		ctx,
+		`INSERT INTO passkeys (id, user_id, name, public_key, sign_count)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT DO NOTHING
+        RETURNING created_at`,
+		credential.Id, user.Id, req.Name, credential.PublicKey, int64(credential.SignCount),
+	).Scan(&info.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Passkey already registered.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJson)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// ListPasskeys lists passkeys of the logged in user.
+func ListPasskeys(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, name, created_at, last_used_at FROM passkeys
+        WHERE user_id = $1 ORDER BY created_at`,
+		user.Id,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	passkeys, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (passkeyInfo, error) {
+		var p passkeyInfo
+		err := row.Scan((*[]byte)(&p.Id), &p.Name, &p.CreatedAt, &p.LastUsedAt)
+		return p, err
+	})
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+// DeletePasskey removes a passkey of the logged in user. The id is base64url
+// encoded. The last passkey of an account without a password or an identity
+// provider can't be removed.
+func DeletePasskey(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	id, err := base64.RawURLEncoding.DecodeString(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Passkey not found.", http.StatusNotFound)
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	methods, err := lockLoginMethods(tx, ctx, user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	ct, err := tx.Exec(
+		ctx, `DELETE FROM passkeys WHERE id = $1 AND user_id = $2`, id, user.Id,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if ct.RowsAffected() == 0 {
+		http.Error(w, "Passkey not found.", http.StatusNotFound)
+		return
+	}
+	if methods.count() == 1 {
+		http.Error(w, "Set a password before removing your last passkey.", http.StatusConflict)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// passkeyLoginOptions are PublicKeyCredentialRequestOptions for
+// navigator.credentials.get. No credentials are listed, the browser offers
+// the passkeys it has for the site.
+type passkeyLoginOptions struct {
+	Challenge        base64URL `json:"challenge"`
+	RPId             string    `json:"rpId"`
+	Timeout          int64     `json:"timeout"`
+	UserVerification string    `json:"userVerification"`
+}
+
+func BeginPasskeyLogin(
+	conn *pgxpool.Pool, ctx context.Context, rp webauthn.RelyingParty,
+	w http.ResponseWriter, r *http.Request,
+) {
+	challenge, err := createWebauthnChallenge(conn, ctx, nil)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(passkeyLoginOptions{
+		Challenge:        challenge,
+		RPId:             rp.ID,
+		Timeout:          webauthnChallengeDuration.Milliseconds(),
+		UserVerification: "required",
+	})
+}
+
+type finishPasskeyLoginRequest struct {
+	CredentialId      base64URL `json:"credentialId"`
+	ClientDataJSON    base64URL `json:"clientDataJSON"`
+	AuthenticatorData base64URL `json:"authenticatorData"`
+	Signature         base64URL `json:"signature"`
+	UserHandle        base64URL `json:"userHandle"`
+}
+
+// FinishPasskeyLogin logs the user in with a passkey. The passkey already
+// verifies the user on the device, so no second factor is asked for.
+func FinishPasskeyLogin(
+	conn *pgxpool.Pool, ctx context.Context, rp webauthn.RelyingParty,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req finishPasskeyLoginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	challenge, ok, err := consumeWebauthnChallenge(conn, ctx, req.ClientDataJSON, nil)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired challenge.", http.StatusBadRequest)
+		return
+	}
+
+	var userId int
+	var verified bool
+	var signCount int64
+	credential := webauthn.Credential{Id: req.CredentialId}
+	err = conn.QueryRow(
+		ctx,
+		`SELECT p.user_id, p.public_key, p.sign_count, u.verified
+        FROM passkeys p JOIN users u ON u.id = p.user_id
+        WHERE p.id = $1`,
+		[]byte(req.CredentialId),
+	).Scan(&userId, &credential.PublicKey, &signCount, &verified)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Access denied.", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if req.UserHandle != nil && !bytes.Equal(req.UserHandle, userHandle(userId)) {
+		http.Error(w, "Access denied.", http.StatusUnauthorized)
+		return
+	}
+	credential.SignCount = uint32(signCount)
+
+	newSignCount, err := rp.VerifyLogin(
+		challenge, credential, req.ClientDataJSON, req.AuthenticatorData, req.Signature,
+	)
+	if err != nil {
+		log.Printf("Passkey login failed for user %v: %v\n", userId, err)
+		http.Error(w, "Access denied.", http.StatusUnauthorized)
+		return
+	}
+	if !verified {
+		http.Error(w, "Email not verified. Use the link we sent you or request a new one.", http.StatusForbidden)
+		return
+	}
+
+	_, err = conn.Exec(
+		ctx,
+		`UPDATE passkeys SET sign_count = $2, last_used_at = now() WHERE id = $1`,
+		[]byte(credential.Id), int64(newSignCount),
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	err = createSession(conn, ctx, w, r, userId)
+	if err != nil {
+		loginErr(w, err)
+		return
+	}
+	w.Write([]byte("Access granted."))
+}
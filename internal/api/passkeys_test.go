@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func createTestPasskey(t *testing.T, pool *pgxpool.Pool, user User) string {
+	t.Helper()
+	id := uuid.New()
+	_, err := pool.Exec(
+		context.Background(),
+		`INSERT INTO passkeys (id, user_id, name, public_key) VALUES ($1, $2, 'test', '\x00')`,
+		id[:], user.Id,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+func deletePasskey(pool *pgxpool.Pool, session *http.Cookie, id string) int {
+	w := serveAsUser(pool, session, "DELETE", "", func(
+		conn *pgxpool.Pool, ctx context.Context, w http.ResponseWriter, r *http.Request,
+	) {
+		r.SetPathValue("id", id)
+		DeletePasskey(conn, ctx, w, r)
+	})
+	return w.Code
+}
+
+func TestPasskeyOnlyAccount(t *testing.T) {
+	pool := testPool(t)
+	user := createTestUser(t, pool)
+	pass, err := hashPassword("correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Exec(context.Background(), `UPDATE users SET password = $2 WHERE id = $1`, user.Id, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := logInTestUser(t, pool, user)
+
+	removePassword := func() int {
+		return serveAsUser(pool, session, "POST", `{"password": "correct horse battery"}`, RemovePassword).Code
+	}
+
+	if code := removePassword(); code != http.StatusConflict {
+		t.Errorf("without a passkey: status = %v, want %v", code, http.StatusConflict)
+	}
+
+	first := createTestPasskey(t, pool, user)
+	second := createTestPasskey(t, pool, user)
+	if code := removePassword(); code != http.StatusNoContent {
+		t.Fatalf("status = %v, want %v", code, http.StatusNoContent)
+	}
+	if code := removePassword(); code != http.StatusConflict {
+		t.Errorf("second removal: status = %v, want %v", code, http.StatusConflict)
+	}
+
+	if code := deletePasskey(pool, session, first); code != http.StatusNoContent {
+		t.Errorf("first passkey: status = %v, want %v", code, http.StatusNoContent)
+	}
+	if code := deletePasskey(pool, session, second); code != http.StatusConflict {
+		t.Errorf("last passkey: status = %v, want %v", code, http.StatusConflict)
+	}
+	var passkeys int
+	err = pool.QueryRow(
+		context.Background(), `SELECT count(*) FROM passkeys WHERE user_id = $1`, user.Id,
+	).Scan(&passkeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passkeys != 1 {
+		t.Errorf("%v passkeys left, want 1", passkeys)
+	}
+}
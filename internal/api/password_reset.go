@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const passwordResetTokenDuration = 30 * time.Minute
+
+func passwordResetLinkHtml(token string) string {
+	link := `https://www.` + Domain + `/reset-password?token=` + token
+	return `<a href="` + link + `">` + link + `</a>`
+}
+
+func SendPasswordResetEmail(ctx context.Context, sendEmail EmailSender, to, token string) error {
+	linkHtml := passwordResetLinkHtml(token)
+	email := Email{
+		From:          "reset-password@" + Domain,
+		To:            to,
+		Subject:       "Sudoku - Reset Password",
+		HtmlBody:      `Hi,<br><br>here is your password reset link: ` + linkHtml + `<br><br>If you didn't ask to reset your password, you can ignore this email.<br><br>Best,<br>Oskar`,
+		MessageStream: MessageStreamOutbound,
+	}
+	return sendEmail(ctx, email)
+}
+
+// SendAccountExistsEmail is sent instead of a verification email when someone
+// registers with an email of an existing account.
+func SendAccountExistsEmail(ctx context.Context, sendEmail EmailSender, to, token string) error {
+	linkHtml := passwordResetLinkHtml(token)
+	email := Email{
+		From:          "reset-password@" + Domain,
+		To:            to,
+		Subject:       "Sudoku - You Already Have an Account",
+		HtmlBody:      `Hi,<br><br>someone tried to register with your email, but you already have an account. If it was you and you don't remember your password, you can reset it here: ` + linkHtml + `<br><br>Otherwise, you can ignore this email.<br><br>Best,<br>Oskar`,
+		MessageStream: MessageStreamOutbound,
+	}
+	return sendEmail(ctx, email)
+}
+
+func createPasswordResetToken(conn *pgxpool.Pool, ctx context.Context, userId int) (string, error) {
+	expires_at := time.Now().Add(passwordResetTokenDuration)
+	var token string
+	err := conn.QueryRow(
+		ctx,
+		`INSERT INTO password_reset_tokens (user_id, expires_at) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+            SET token = gen_random_uuid(),
+                expires_at = $2
+        RETURNING token`,
+		userId, expires_at,
+	).Scan(&token)
+	return token, err
+}
+
+// sendInBackground sends the email without making the client wait for it, so
+// that response times don't reveal whether an email was sent at all.
+func sendInBackground(send func(ctx context.Context) error) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := send(ctx); err != nil {
+			log.Printf("ERR: Failed to send email: %v\n", err)
+		}
+	}()
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ForgotPassword emails a password reset link. The response is the same
+// whether the email is registered or not.
+func ForgotPassword(
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender, debug bool,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req forgotPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	var ok bool
+	req.Email, ok = normalizeEmail(w, req.Email)
+	if !ok {
+		return
+	}
+
+	var userId int
+	err = conn.QueryRow(
+		ctx, `SELECT id FROM users WHERE lower(email) = lower($1)`, req.Email,
+	).Scan(&userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	token, err := createPasswordResetToken(conn, ctx, userId)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if debug {
+		log.Printf("Password reset: '%v', token: %v\n", req.Email, token)
+	}
+
+	sendInBackground(func(ctx context.Context) error {
+		return SendPasswordResetEmail(ctx, sendEmail, req.Email, token)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ResetPassword sets a new password using a token from a password reset email.
+// The token can be used once and all sessions of the user are ended.
+func ResetPassword(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req resetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+	if uuid.Validate(req.Token) != nil {
+		http.Error(w, "Invalid or expired token.", http.StatusBadRequest)
+		return
+	}
+	if !checkPasswordPolicy(w, req.Password) {
+		return
+	}
+
+	pass, err := hashPassword(req.Password)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var expires_at time.Time
+	var user_id int
+	err = tx.QueryRow(
+		ctx,
+		`DELETE FROM password_reset_tokens WHERE token = $1 RETURNING user_id, expires_at`,
+		req.Token,
+	).Scan(&user_id, &expires_at)
+
+	if err != nil || time.Now().After(expires_at) {
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			internalErr(w, err)
+			return
+		}
+		http.Error(w, "Invalid or expired token.", http.StatusBadRequest)
+		return
+	}
+
+	// The link was sent by email so it also proves that the email is valid.
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE users SET password = $2, verified = true WHERE id = $1`,
+		user_id, pass,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	err = deleteUserSessions(tx, ctx, user_id, "")
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	err = clearFailedLogins(tx, ctx, user_id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const SessionCookieName = "session"
+
+const sessionDuration = 30 * 24 * time.Hour
+
+// Sessions are extended on use once less than this much time is left.
+const sessionRenewBefore = sessionDuration / 2
+
+// How often last seen time of a session is updated.
+const sessionLastSeenInterval = 5 * time.Minute
+
+// SecureCookies marks cookies as HTTPS only. Can be disabled for local development.
+var SecureCookies = true
+
+type User struct {
+	Id    int
+	Email string
+	Role  Role
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	sessionIdContextKey
+)
+
+// UserFromContext returns the user authenticated by the Authenticate middleware.
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userContextKey).(User)
+	return user, ok
+}
+
+func sessionIdFromContext(ctx context.Context) (string, bool) {
+	sessionId, ok := ctx.Value(sessionIdContextKey).(string)
+	return sessionId, ok
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Only hashes of session tokens are stored so that a leaked database can't be
+// used to log in.
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		Secure:   SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   SecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+var errAccountDisabled = errors.New("account disabled")
+
+// loginErr responds to an error from logIn or createSession.
+func loginErr(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAccountDisabled) {
+		http.Error(w, "Account disabled.", http.StatusForbidden)
+		return
+	}
+	internalErr(w, err)
+}
+
+// createSession logs the user in, unless the account is disabled.
+func createSession(
+	conn *pgxpool.Pool, ctx context.Context, w http.ResponseWriter, r *http.Request, userId int,
+) error {
+	var disabled bool
+	err := conn.QueryRow(ctx, `SELECT disabled FROM users WHERE id = $1`, userId).Scan(&disabled)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return errAccountDisabled
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(sessionDuration)
+	_, err = conn.Exec(
+		ctx,
+		`INSERT INTO sessions (user_id, token_hash, expires_at, user_agent)
+        VALUES ($1, $2, $3, $4)`,
+		userId, hashToken(token), expiresAt, r.UserAgent(),
+	)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, token, expiresAt)
+	return nil
+}
+
+// Authenticate puts the user owning the session cookie in the request context.
+// Requests without a valid session are passed on without a user. API tokens
+// are rejected, see AuthenticateWithScope.
+func Authenticate(conn *pgxpool.Pool, ctx context.Context, next http.Handler) http.Handler {
+	return AuthenticateWithScope(conn, ctx, "", next)
+}
+
+// AuthenticateWithScope works like Authenticate but also accepts API tokens
+// with the given scope in the Authorization header.
+func AuthenticateWithScope(
+	conn *pgxpool.Pool, ctx context.Context, scope Scope, next http.Handler,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			token, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok {
+				http.Error(w, "Invalid authorization header.", http.StatusUnauthorized)
+				return
+			}
+			if scope == "" {
+				http.Error(w, "API tokens can't be used here.", http.StatusForbidden)
+				return
+			}
+			authenticateToken(conn, ctx, scope, strings.TrimSpace(token), next, w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(SessionCookieName)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var user User
+		var sessionId string
+		var expiresAt, lastSeenAt time.Time
+		err = conn.QueryRow(
+			ctx,
+			`SELECT s.id, s.expires_at, s.last_seen_at, u.id, u.email, u.role
+            FROM sessions s JOIN users u ON u.id = s.user_id
+            WHERE s.token_hash = $1 AND s.expires_at > now() AND NOT u.disabled`,
+			hashToken(cookie.Value),
+		).Scan(&sessionId, &expiresAt, &lastSeenAt, &user.Id, &user.Email, &user.Role)
+		if errors.Is(err, pgx.ErrNoRows) {
+			clearSessionCookie(w)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			internalErr(w, err)
+			return
+		}
+
+		renew := time.Until(expiresAt) < sessionRenewBefore
+		if renew || time.Since(lastSeenAt) > sessionLastSeenInterval {
+			if renew {
+				expiresAt = time.Now().Add(sessionDuration)
+			}
+			_, err = conn.Exec(
+				ctx,
+				`UPDATE sessions SET expires_at = $2, last_seen_at = now() WHERE id = $1`,
+				sessionId, expiresAt,
+			)
+			if err != nil {
+				internalErr(w, err)
+				return
+			}
+			if renew {
+				setSessionCookie(w, cookie.Value, expiresAt)
+			}
+		}
+
+		reqCtx := context.WithValue(r.Context(), userContextKey, user)
+		reqCtx = context.WithValue(reqCtx, sessionIdContextKey, sessionId)
+		next.ServeHTTP(w, r.WithContext(reqCtx))
+	})
+}
+
+// RequireUser rejects requests without an authenticated user. It has to be
+// wrapped by Authenticate.
+func RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := UserFromContext(r.Context()); !ok {
+			http.Error(w, "Not logged in.", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// RequireRole rejects requests of users without the role. It has to be
+// wrapped by Authenticate and RequireUser.
+func RequireRole(role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _ := UserFromContext(r.Context()); user.Role != role {
+			http.Error(w, "Not allowed.", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// executor is implemented by both *pgxpool.Pool and pgx.Tx.
+type executor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// deleteUserSessions logs the user out everywhere except for the given session.
+// Pass an empty exceptSessionId to delete all sessions.
+func deleteUserSessions(
+	conn executor, ctx context.Context, userId int, exceptSessionId string,
+) error {
+	var err error
+	if exceptSessionId == "" {
+		_, err = conn.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, userId)
+	} else {
+		_, err = conn.Exec(
+			ctx,
+			`DELETE FROM sessions WHERE user_id = $1 AND id <> $2`,
+			userId, exceptSessionId,
+		)
+	}
+	return err
+}
+
+func Logout(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	if sessionId, ok := sessionIdFromContext(r.Context()); ok {
+		_, err := conn.Exec(ctx, `DELETE FROM sessions WHERE id = $1`, sessionId)
+		if err != nil {
+			internalErr(w, err)
+			return
+		}
+	}
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type sessionInfo struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+// ListSessions lists active sessions of the logged in user.
+func ListSessions(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	currentId, _ := sessionIdFromContext(r.Context())
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, user_agent, created_at, last_seen_at, expires_at FROM sessions
+        WHERE user_id = $1 AND expires_at > now()
+        ORDER BY last_seen_at DESC`,
+		user.Id,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	sessions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (sessionInfo, error) {
+		var s sessionInfo
+		err := row.Scan(&s.Id, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+		s.Current = s.Id == currentId
+		return s, err
+	})
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// DeleteSession logs the user out on another device.
+func DeleteSession(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	sessionId := r.PathValue("id")
+	if uuid.Validate(sessionId) != nil {
+		http.Error(w, "Session not found.", http.StatusNotFound)
+		return
+	}
+	ct, err := conn.Exec(
+		ctx,
+		`DELETE FROM sessions WHERE id = $1 AND user_id = $2`,
+		sessionId, user.Id,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if ct.RowsAffected() == 0 {
+		http.Error(w, "Session not found.", http.StatusNotFound)
+		return
+	}
+	if currentId, _ := sessionIdFromContext(r.Context()); currentId == sessionId {
+		clearSessionCookie(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteOtherSessions logs the user out everywhere but the current session.
+func DeleteOtherSessions(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+	currentId, _ := sessionIdFromContext(r.Context())
+	if err := deleteUserSessions(conn, ctx, user.Id, currentId); err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oskarrrrrrr/sudoku-web/internal/migrations"
+)
+
+// testPool connects to the database in TEST_DATABASE_URL and runs the
+// migrations. Tests that need a database are skipped when it isn't set.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	err = migrations.RunAll(conn.Conn(), ctx, migrations.ListMigrations("../../migrations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// createTestUser inserts a verified user with a unique email and no password.
+// The user is deleted when the test ends.
+func createTestUser(t *testing.T, pool *pgxpool.Pool) User {
+	t.Helper()
+	ctx := context.Background()
+	user := User{Email: "test-" + uuid.NewString() + "@example.com", Role: RoleUser}
+	err := pool.QueryRow(
+		ctx,
+		`INSERT INTO users (email, password, verified) VALUES ($1, '', true) RETURNING id`,
+		user.Email,
+	).Scan(&user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, err := pool.Exec(context.Background(), `DELETE FROM users WHERE id = $1`, user.Id)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	return user
+}
+
+// logInTestUser creates a session for the user and returns its cookie.
+func logInTestUser(t *testing.T, pool *pgxpool.Pool, user User) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	err := createSession(pool, context.Background(), w, httptest.NewRequest("POST", "/api/login", nil), user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookieName {
+			return &http.Cookie{Name: c.Name, Value: c.Value}
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+// serveAsUser calls the handler as Authenticate would for a request with the
+// session cookie and a JSON body.
+func serveAsUser(
+	pool *pgxpool.Pool, session *http.Cookie, method, body string,
+	handler func(*pgxpool.Pool, context.Context, http.ResponseWriter, *http.Request),
+) *httptest.ResponseRecorder {
+	ctx := context.Background()
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	r.AddCookie(session)
+	w := httptest.NewRecorder()
+	Authenticate(pool, ctx, RequireUser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(pool, ctx, w, r)
+	}))).ServeHTTP(w, r)
+	return w
+}
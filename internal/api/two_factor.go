@@ -0,0 +1,385 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oskarrrrrrr/sudoku-web/internal/totp"
+)
+
+// How long the user has to enter the second factor after the password.
+const loginChallengeDuration = 5 * time.Minute
+
+// Number of wrong codes after which the password has to be entered again.
+const loginChallengeMaxAttempts = 5
+
+const recoveryCodeCount = 10
+
+const totpIssuer = "BoringSudoku"
+
+// logIn creates a session for the user. When the user has two-factor
+// authentication enabled a login challenge is created instead and its token is
+// returned. The challenge is finished with LoginTwoFactor. Disabled accounts
+// get errAccountDisabled.
+func logIn(
+	conn *pgxpool.Pool, ctx context.Context, w http.ResponseWriter, r *http.Request, userId int,
+) (string, error) {
+	var totpEnabled, disabled bool
+	err := conn.QueryRow(
+		ctx, `SELECT totp_enabled, disabled FROM users WHERE id = $1`, userId,
+	).Scan(&totpEnabled, &disabled)
+	if err != nil {
+		return "", err
+	}
+	if disabled {
+		return "", errAccountDisabled
+	}
+	if !totpEnabled {
+		return "", createSession(conn, ctx, w, r, userId)
+	}
+
+	challenge, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = conn.Exec(
+		ctx,
+		`INSERT INTO login_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`,
+		hashToken(challenge), userId, time.Now().Add(loginChallengeDuration),
+	)
+	return challenge, err
+}
+
+type loginChallengeResponse struct {
+	Challenge string `json:"challenge"`
+}
+
+// writeLoginChallenge tells the client that a second factor is required.
+func writeLoginChallenge(w http.ResponseWriter, challenge string) {
+	w.Header().Set("Content-Type", ContentTypeJson)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(loginChallengeResponse{Challenge: challenge})
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+	return code[:4] + "-" + code[4:], nil
+}
+
+// Recovery codes are compared ignoring case, spaces and dashes.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// replaceRecoveryCodes invalidates all recovery codes of the user and returns
+// new ones. Only their hashes are stored.
+func replaceRecoveryCodes(tx pgx.Tx, ctx context.Context, userId int) ([]string, error) {
+	_, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userId)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)
+            ON CONFLICT DO NOTHING`,
+			userId, hashToken(normalizeRecoveryCode(code)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+type totpSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// SetupTOTP starts the enrolment of an authenticator app. The returned URI is
+// meant to be shown as a QR code. Two-factor authentication is enabled only
+// after a code is confirmed with EnableTOTP.
+func SetupTOTP(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	ct, err := conn.Exec(
+		ctx,
+		`UPDATE users SET totp_secret = $2 WHERE id = $1 AND NOT totp_enabled`,
+		user.Id, secret,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if ct.RowsAffected() == 0 {
+		http.Error(w, "Two-factor authentication already enabled.", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(totpSetupResponse{
+		Secret: totp.EncodeSecret(secret),
+		URI:    totp.URI(totpIssuer, user.Email, secret),
+	})
+}
+
+type enableTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// EnableTOTP turns on two-factor authentication once the user proves that the
+// authenticator app works. The recovery codes are returned only this once.
+func EnableTOTP(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req enableTOTPRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	var secret []byte
+	var enabled bool
+	err = tx.QueryRow(
+		ctx,
+		`SELECT totp_secret, totp_enabled FROM users WHERE id = $1 FOR UPDATE`,
+		user.Id,
+	).Scan(&secret, &enabled)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication already enabled.", http.StatusConflict)
+		return
+	}
+	if secret == nil {
+		http.Error(w, "Two-factor setup not started.", http.StatusBadRequest)
+		return
+	}
+	step, ok := totp.Validate(secret, strings.TrimSpace(req.Code), time.Now(), 0)
+	if !ok {
+		http.Error(w, "Invalid code.", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE users SET totp_enabled = true, totp_last_step = $2 WHERE id = $1`,
+		user.Id, step,
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, ctx, user.Id)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJson)
+	json.NewEncoder(w).Encode(recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+type disableTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+// DisableTOTP turns off two-factor authentication after confirming the
+// password, or a recent login for accounts without one, see reauthenticate.
+func DisableTOTP(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	user, _ := UserFromContext(r.Context())
+
+	var req disableTOTPRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	if !reauthenticate(conn, ctx, req.Password, "", w, r) {
+		return
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE users SET totp_enabled = false, totp_secret = NULL, totp_last_step = 0
+        WHERE id = $1`,
+		user.Id,
+	)
+	if err == nil {
+		_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, user.Id)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `DELETE FROM login_challenges WHERE user_id = $1`, user.Id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type loginTwoFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// LoginTwoFactor finishes a login started with a password by checking a code
+// from the authenticator app or a recovery code.
+func LoginTwoFactor(
+	conn *pgxpool.Pool, ctx context.Context,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req loginTwoFactorRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	// Every attempt is counted before the code is checked so that guessing is
+	// limited even with concurrent requests.
+	var userId int
+	err = conn.QueryRow(
+		ctx,
+		`UPDATE login_challenges SET attempts = attempts + 1
+        WHERE token_hash = $1 AND expires_at > now() AND attempts < $2
+        RETURNING user_id`,
+		hashToken(req.Challenge), loginChallengeMaxAttempts,
+	).Scan(&userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "Login expired. Log in again.", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	ok, err := checkSecondFactor(conn, ctx, userId, req.Code)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code.", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = conn.Exec(
+		ctx, `DELETE FROM login_challenges WHERE token_hash = $1`, hashToken(req.Challenge),
+	)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+	err = createSession(conn, ctx, w, r, userId)
+	if err != nil {
+		loginErr(w, err)
+		return
+	}
+	w.Write([]byte("Access granted."))
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code. Both can be used only once.
+func checkSecondFactor(conn *pgxpool.Pool, ctx context.Context, userId int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		var secret []byte
+		var lastStep int64
+		err := conn.QueryRow(
+			ctx,
+			`SELECT totp_secret, totp_last_step FROM users WHERE id = $1 AND totp_enabled`,
+			userId,
+		).Scan(&secret, &lastStep)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		step, ok := totp.Validate(secret, code, time.Now(), lastStep)
+		if !ok {
+			return false, nil
+		}
+		ct, err := conn.Exec(
+			ctx,
+			`UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2`,
+			userId, step,
+		)
+		return err == nil && ct.RowsAffected() == 1, err
+	}
+
+	ct, err := conn.Exec(
+		ctx,
+		`UPDATE recovery_codes SET used_at = now()
+        WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userId, hashToken(normalizeRecoveryCode(code)),
+	)
+	return err == nil && ct.RowsAffected() == 1, err
+}
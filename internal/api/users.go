@@ -6,12 +6,14 @@ import (
 	"errors"
 	"log"
 	"net/http"
-	"regexp"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/oskarrrrrrr/sudoku-web/internal/emailaddr"
+	"github.com/oskarrrrrrr/sudoku-web/internal/passhash"
+	"github.com/oskarrrrrrr/sudoku-web/internal/passpolicy"
 )
 
 const Domain = "boringsudoku.com"
@@ -25,29 +27,24 @@ func internalErr(w http.ResponseWriter, err error) {
 	log.Printf("Inernal err: %v", err)
 }
 
-func hashPassword(pass string) ([]byte, error) {
-	const BCRYPT_MAX_PASS_LEN = 72
-	const BCRYPT_COST = 10 // same as default at the moment, should take ~100ms
-	if len(pass) > BCRYPT_MAX_PASS_LEN {
-		pass = pass[:BCRYPT_MAX_PASS_LEN]
-	}
-	return bcrypt.GenerateFromPassword([]byte(pass), BCRYPT_COST)
+func hashPassword(pass string) (string, error) {
+	return passhash.Hash(pass)
 }
 
 func checkPassword(hash, pass string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	ok, _ := passhash.Verify(hash, pass)
+	return ok
 }
 
-func validateEmail(email string) (bool, error) {
-	if len(email) > 320 {
-		return false, nil
-	}
-	emailOk, err := regexp.Match(`^[^@]+@[^@]+\.[^@]+$`, []byte(email))
+// normalizeEmail responds with an error and returns false if the email is not
+// valid. Emails are stored and looked up normalized, compared ignoring case.
+func normalizeEmail(w http.ResponseWriter, email string) (string, bool) {
+	email, err := emailaddr.Normalize(email)
 	if err != nil {
-		log.Printf("ERR: Failed email validation: '%s'\n", email)
-		return false, err
+		http.Error(w, "Invalid email format.", http.StatusBadRequest)
+		return "", false
 	}
-	return emailOk, nil
+	return email, true
 }
 
 type loginCredentials struct {
@@ -55,8 +52,14 @@ type loginCredentials struct {
 	Password string `json:"password"`
 }
 
+// Perform the same amount of work regardless of whether the email exists.
+// This should prevent a timing attack that tries to detect if an email is registered.
+func dummyCheckPassword() {
+	passhash.VerifyDummy()
+}
+
 func Login(
-	conn *pgx.Conn, ctx context.Context,
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender,
 	w http.ResponseWriter, r *http.Request,
 ) {
 	var creds loginCredentials
@@ -66,49 +69,134 @@ func Login(
 		return
 	}
 
-	emailOk, err := validateEmail(creds.Email)
-	if err != nil {
-		internalErr(w, err)
-		return
-	}
-	if !emailOk {
-		http.Error(w, "Invalid email format.", http.StatusBadRequest)
-		return
-	}
-	if len(creds.Password) < PASSWORD_MIN_LEN {
-		http.Error(w, "Password too short.", http.StatusBadRequest)
+	var ok bool
+	creds.Email, ok = normalizeEmail(w, creds.Email)
+	if !ok {
 		return
 	}
 
+	var userId int
 	var password string
 	var verified bool
+	var failedLogins int
+	var lockedUntil *time.Time
 	err = conn.QueryRow(
 		ctx,
-		"SELECT password, verified FROM users WHERE email = $1",
+		`SELECT id, password, verified, failed_logins, locked_until
+        FROM users WHERE lower(email) = lower($1)`,
 		creds.Email,
-	).Scan(&password, &verified)
-
-	if !verified || err != nil {
-		if !verified || errors.Is(err, pgx.ErrNoRows) {
-			// Perform the same amount of work regardless of whether the email exists.
-			// This should prevent a timing attack that tries to detect if an email is registered.
-			const DUMMY_PASS = "$2a$10$jC.KuAg.b116zcRTLTUcS.h/puEb.QViFkuB3tbvvmJXfMXSz.jIm"
-			checkPassword(DUMMY_PASS, "abc123")
-			http.Error(w, "Access denied.", http.StatusUnauthorized)
-		} else {
+	).Scan(&userId, &password, &verified, &failedLogins, &lockedUntil)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		dummyCheckPassword()
+		http.Error(w, "Access denied.", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	// Locked accounts look the same as a wrong password to the client.
+	if lockedUntil != nil && time.Now().Before(*lockedUntil) {
+		dummyCheckPassword()
+		http.Error(w, "Access denied.", http.StatusUnauthorized)
+		return
+	}
+
+	passOk, needsRehash := passhash.Verify(password, creds.Password)
+	if !passOk {
+		if verified {
+			err = recordFailedLogin(conn, ctx, sendEmail, userId, creds.Email)
+			if err != nil {
+				internalErr(w, err)
+				return
+			}
+		}
+		http.Error(w, "Access denied.", http.StatusUnauthorized)
+		return
+	}
+	// Only someone who knows the password learns that the email is not
+	// verified, so it doesn't reveal which emails are registered.
+	if !verified {
+		http.Error(w, "Email not verified. Use the link we sent you or request a new one.", http.StatusForbidden)
+		return
+	}
+	if failedLogins > 0 {
+		err = clearFailedLogins(conn, ctx, userId)
+		if err != nil {
 			internalErr(w, err)
+			return
+		}
+	}
+	// Upgrade hashes created with old parameters while the password is known.
+	if needsRehash {
+		err = rehashPassword(conn, ctx, userId, password, creds.Password)
+		if err != nil {
+			log.Printf("ERR: Failed to rehash password of user %v: %v\n", userId, err)
 		}
+	}
+	challenge, err := logIn(conn, ctx, w, r, userId)
+	if err != nil {
+		loginErr(w, err)
+		return
+	}
+	if challenge != "" {
+		writeLoginChallenge(w, challenge)
 		return
 	}
+	w.Write([]byte("Access granted."))
+}
 
-	if checkPassword(password, creds.Password) {
-		w.Write([]byte("Access granted."))
-	} else {
-		http.Error(w, "Access denied.", http.StatusUnauthorized)
+// rehashPassword replaces the stored hash unless the password was changed in
+// the meantime.
+func rehashPassword(conn *pgxpool.Pool, ctx context.Context, userId int, oldHash, pass string) error {
+	newHash, err := hashPassword(pass)
+	if err != nil {
+		return err
 	}
+	_, err = conn.Exec(
+		ctx,
+		`UPDATE users SET password = $3 WHERE id = $1 AND password = $2`,
+		userId, oldHash, newHash,
+	)
+	return err
 }
 
-const PASSWORD_MIN_LEN = 8
+// PasswordPolicy is applied whenever a user chooses a password.
+var PasswordPolicy = passpolicy.Default()
+
+// The limits let the client explain length violations without knowing the
+// policy. MaxLength is left out when there is no limit.
+type passwordPolicyError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	MinLength int    `json:"minLength"`
+	MaxLength int    `json:"maxLength,omitempty"`
+}
+
+// checkPasswordPolicy responds with an error and returns false if the password
+// is not allowed. The error has a code the client can show its own message for.
+func checkPasswordPolicy(w http.ResponseWriter, pass string) bool {
+	err := PasswordPolicy.Check(pass)
+	var violation *passpolicy.Violation
+	if errors.As(err, &violation) {
+		w.Header().Set("Content-Type", ContentTypeJson)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(passwordPolicyError{
+			Code:      violation.Code,
+			Message:   violation.Message,
+			MinLength: PasswordPolicy.MinLen,
+			MaxLength: PasswordPolicy.MaxLen,
+		})
+		return false
+	}
+	if err != nil {
+		internalErr(w, err)
+		return false
+	}
+	return true
+}
 
 type createUserCredentials struct {
 	Email    string `json:"email"`
@@ -128,8 +216,23 @@ func SendNewUserEmail(ctx context.Context, sendEmail EmailSender, to, token stri
 	return sendEmail(ctx, email)
 }
 
+func createVerificationToken(conn *pgxpool.Pool, ctx context.Context, userId int) (string, error) {
+	expires_at := time.Now().Add(15 * time.Minute)
+	var token string
+	err := conn.QueryRow(
+		ctx,
+		`INSERT INTO verification_tokens (user_id, expires_at) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+            SET token = gen_random_uuid(),
+                expires_at = $2
+        RETURNING token`,
+		userId, expires_at,
+	).Scan(&token)
+	return token, err
+}
+
 func CreateUser(
-	conn *pgx.Conn, ctx context.Context, sendEmail EmailSender, debug bool,
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender, debug bool,
 	w http.ResponseWriter, r *http.Request,
 ) {
 	var creds createUserCredentials
@@ -139,17 +242,12 @@ func CreateUser(
 		return
 	}
 
-	emailOk, err := regexp.Match(`^[^@]+@[^@]+\.[^@]+$`, []byte(creds.Email))
-	if err != nil {
-		internalErr(w, err)
-		return
-	}
-	if !emailOk {
-		http.Error(w, "Invalid email format.", http.StatusBadRequest)
+	var ok bool
+	creds.Email, ok = normalizeEmail(w, creds.Email)
+	if !ok {
 		return
 	}
-	if len(creds.Password) < PASSWORD_MIN_LEN {
-		http.Error(w, "Password too short.", http.StatusBadRequest)
+	if !checkPasswordPolicy(w, creds.Password) {
 		return
 	}
 
@@ -159,7 +257,8 @@ func CreateUser(
 		return
 	}
 
-	var userId string
+	var userId int
+	var verified bool
 	err = conn.QueryRow(
 		ctx,
 		`INSERT INTO users (email, password) VALUES ($1, $2)
@@ -168,30 +267,38 @@ func CreateUser(
 	).Scan(&userId)
 
 	if errors.Is(err, pgx.ErrNoRows) {
-		// TODO: send password reset link instead
 		err = conn.QueryRow(
 			ctx,
-			`SELECT id FROM users WHERE email =  $1`,
+			`SELECT id, verified FROM users WHERE lower(email) = lower($1)`,
 			creds.Email,
-		).Scan(&userId)
+		).Scan(&userId, &verified)
 	}
 	if err != nil {
 		internalErr(w, err)
 		return
 	}
 
-	expires_at := time.Now().Add(15 * time.Minute)
-	var token string
-	err = conn.QueryRow(
-		ctx,
-		`INSERT INTO verification_tokens (user_id, expires_at) VALUES ($1, $2)
-        ON CONFLICT (user_id) DO UPDATE
-            SET token = gen_random_uuid(),
-                expires_at = $2
-        RETURNING token`,
-		userId, expires_at,
-	).Scan(&token)
+	// The response has to be the same as for a new user, otherwise it would
+	// reveal which emails are registered.
+	if verified {
+		token, err := createPasswordResetToken(conn, ctx, userId)
+		if err != nil {
+			internalErr(w, err)
+			return
+		}
+		if debug {
+			log.Printf("Existing user: '%v', password reset token: %v\n", creds.Email, token)
+		}
+		err = SendAccountExistsEmail(ctx, sendEmail, creds.Email, token)
+		if err != nil {
+			internalErr(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
+	token, err := createVerificationToken(conn, ctx, userId)
 	if err != nil {
 		internalErr(w, err)
 		return
@@ -210,7 +317,7 @@ func CreateUser(
 }
 
 func VerifyUser(
-	conn *pgx.Conn, ctx context.Context,
+	conn *pgxpool.Pool, ctx context.Context,
 	htmlOnSuccess, htmlOnFail []byte,
 	w http.ResponseWriter, r *http.Request,
 ) {
@@ -251,3 +358,56 @@ func VerifyUser(
 	tx.Commit(ctx)
 	w.Write(htmlOnSuccess)
 }
+
+type resendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// ResendVerification emails a new verification link to an unverified user.
+// The response is the same whether the email is registered or not.
+func ResendVerification(
+	conn *pgxpool.Pool, ctx context.Context, sendEmail EmailSender, debug bool,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req resendVerificationRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		parseErr(w)
+		return
+	}
+
+	var ok bool
+	req.Email, ok = normalizeEmail(w, req.Email)
+	if !ok {
+		return
+	}
+
+	var userId int
+	var verified bool
+	err = conn.QueryRow(
+		ctx, `SELECT id, verified FROM users WHERE lower(email) = lower($1)`, req.Email,
+	).Scan(&userId, &verified)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && verified) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	token, err := createVerificationToken(conn, ctx, userId)
+	if err != nil {
+		internalErr(w, err)
+		return
+	}
+
+	if debug {
+		log.Printf("Resent verification: '%v', token: %v\n", req.Email, token)
+	}
+
+	sendInBackground(func(ctx context.Context) error {
+		return SendNewUserEmail(ctx, sendEmail, req.Email, token)
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,175 @@
+// Package csrf protects cookie authenticated endpoints from cross-site request
+// forgery. Unsafe requests have to come from an allowed origin and carry the
+// token from the csrf cookie in the X-CSRF-Token header (double-submit).
+//
+// The cookie is HttpOnly, scripts get the token from a meta tag instead:
+// pages contain Placeholder, which InjectToken replaces when serving them.
+package csrf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CookieName = "csrf"
+	HeaderName = "X-CSRF-Token"
+	// Placeholder is put in pages at build time and replaced with the token of
+	// the browser when they are served.
+	Placeholder = "__CSRF_TOKEN__"
+)
+
+const cookieDuration = 365 * 24 * time.Hour
+
+type Config struct {
+	// Origins requests may come from, e.g. https://www.example.com.
+	Origins []string
+	// Secure marks the cookie as HTTPS only.
+	Secure bool
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// token returns the token of the browser, setting a new one if there is none.
+func (c Config) token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(CookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(cookieDuration),
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+func forbidden(w http.ResponseWriter) {
+	http.Error(w, "Cross-site request rejected. Reload the page and try again.", http.StatusForbidden)
+}
+
+// Protect rejects unsafe requests that may be forged by another site.
+// Requests with an Authorization header are let through: browsers don't add
+// it on their own and cookies are ignored when it is present.
+func (c Config) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Sent by all current browsers, the origin check covers older ones.
+		if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+			forbidden(w)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !slices.Contains(c.Origins, origin) {
+			forbidden(w)
+			return
+		}
+
+		cookie, err := r.Cookie(CookieName)
+		header := r.Header.Get(HeaderName)
+		if err != nil || header == "" ||
+			subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			forbidden(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Paths without an extension are served as HTML pages by the file server.
+func isPage(urlPath string) bool {
+	ext := path.Ext(urlPath)
+	return ext == "" || ext == ".html"
+}
+
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// InjectToken replaces Placeholder in HTML pages served by next with the
+// token of the browser. Pages are not cached since the token can change.
+func (c Config) InjectToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isPage(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, err := c.token(w, r)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// A cached or partial page could contain an old token.
+		r = r.Clone(r.Context())
+		for _, h := range []string{"If-Modified-Since", "If-None-Match", "If-Range", "Range"} {
+			r.Header.Del(h)
+		}
+
+		buf := &bufferedResponse{header: w.Header()}
+		next.ServeHTTP(buf, r)
+		if buf.status == 0 {
+			buf.status = http.StatusOK
+		}
+
+		body := buf.body.Bytes()
+		contentType := buf.header.Get("Content-Type")
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		if strings.HasPrefix(contentType, "text/html") {
+			body = bytes.ReplaceAll(body, []byte(Placeholder), []byte(token))
+			buf.header.Set("Cache-Control", "no-cache")
+			buf.header.Del("Last-Modified")
+		}
+		buf.header.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(buf.status)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,99 @@
+// Package emailaddr validates email addresses and brings them to the form
+// they are stored in, so that one mailbox can't be registered twice.
+//
+// The domain is mapped as for a DNS lookup (UTS #46: lowercased, fullwidth
+// forms and ideographic full stops folded) and converted to its ASCII
+// (punycode) form. The local part is kept as typed, most mail
+// servers ignore its case but some don't, so case-insensitive matching is
+// left to the database (lower(email)).
+package emailaddr
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+var ErrInvalid = errors.New("invalid email address")
+
+const (
+	maxLen       = 254
+	maxLocalLen  = 64
+	maxDomainLen = 253
+	maxLabelLen  = 63
+)
+
+// Normalize returns the address with surrounding whitespace trimmed and the
+// domain in lowercase ASCII, or ErrInvalid. Quoted local parts and IP address
+// literals are not supported.
+func Normalize(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || !utf8.ValidString(address) || !validLocal(local) {
+		return "", ErrInvalid
+	}
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	address = local + "@" + domain
+	if len(address) > maxLen {
+		return "", ErrInvalid
+	}
+	return address, nil
+}
+
+func validLocal(local string) bool {
+	if local == "" || len(local) > maxLocalLen {
+		return false
+	}
+	if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return false
+	}
+	for _, r := range local {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(`"(),:;<>@[\]`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeDomain(domain string) (string, error) {
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", ErrInvalid
+	}
+	// the trailing dot is only known after mapping, it can be e.g. "。"
+	domain = strings.TrimSuffix(domain, ".")
+	labels := strings.Split(domain, ".")
+	// Addresses at top level domains exist in theory only.
+	if len(labels) < 2 {
+		return "", ErrInvalid
+	}
+	for _, label := range labels {
+		if !validLabel(label) {
+			return "", ErrInvalid
+		}
+	}
+	if len(domain) > maxDomainLen {
+		return "", ErrInvalid
+	}
+	return domain, nil
+}
+
+// validLabel checks for letters, digits and hyphens, not at either end.
+func validLabel(label string) bool {
+	if label == "" || len(label) > maxLabelLen || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
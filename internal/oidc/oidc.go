@@ -0,0 +1,241 @@
+// Package oidc implements the OpenID Connect authorization code flow with PKCE
+// for logging in with external identity providers.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes a single identity provider. Endpoints that are left empty
+// are read from the discovery document of the issuer.
+type Config struct {
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"displayName"`
+	Issuer       string   `json:"issuer"`
+	ClientId     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectUrl"`
+	Scopes       []string `json:"scopes"`
+
+	AuthorizationEndpoint string `json:"authorizationEndpoint"`
+	TokenEndpoint         string `json:"tokenEndpoint"`
+	JWKSURI               string `json:"jwksUri"`
+}
+
+// LoadConfigs reads a JSON array of provider configs from a file.
+func LoadConfigs(fileName string) ([]Config, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	for _, c := range configs {
+		if c.Name == "" || c.Issuer == "" || c.ClientId == "" || c.RedirectURL == "" {
+			return nil, fmt.Errorf("provider %q: name, issuer, clientId and redirectUrl are required", c.Name)
+		}
+	}
+	return configs, nil
+}
+
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu   sync.Mutex
+	keys map[string]any
+	// When keys were last fetched, limits refetching on unknown key ids.
+	keysFetchedAt time.Time
+}
+
+// NewProvider creates a provider, fetching the discovery document if some
+// endpoints are not configured. A nil client uses a client with a timeout.
+func NewProvider(ctx context.Context, config Config, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email"}
+	}
+	p := &Provider{Config: config, client: client}
+	if p.AuthorizationEndpoint != "" && p.TokenEndpoint != "" && p.JWKSURI != "" {
+		return p, nil
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &discovery); err != nil {
+		return nil, fmt.Errorf("provider %q: discovery: %w", p.Name, err)
+	}
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf(
+			"provider %q: discovery issuer %q doesn't match %q", p.Name, discovery.Issuer, p.Issuer,
+		)
+	}
+	if p.AuthorizationEndpoint == "" {
+		p.AuthorizationEndpoint = discovery.AuthorizationEndpoint
+	}
+	if p.TokenEndpoint == "" {
+		p.TokenEndpoint = discovery.TokenEndpoint
+	}
+	if p.JWKSURI == "" {
+		p.JWKSURI = discovery.JWKSURI
+	}
+	return p, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %v: unexpected status %v", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// LoginState has to be kept between redirecting the user to the provider and
+// handling the callback.
+type LoginState struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func NewLoginState() (LoginState, error) {
+	var s LoginState
+	var err error
+	if s.State, err = randomString(); err != nil {
+		return s, err
+	}
+	if s.Nonce, err = randomString(); err != nil {
+		return s, err
+	}
+	s.CodeVerifier, err = randomString()
+	return s, err
+}
+
+// AuthURL returns the URL the user is redirected to for logging in.
+func (p *Provider) AuthURL(s LoginState) string {
+	challenge := sha256.Sum256([]byte(s.CodeVerifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientId},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {s.State},
+		"nonce":                 {s.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + q.Encode()
+}
+
+var ErrStateMismatch = errors.New("state doesn't match the cookie")
+
+// CallbackState returns the state of a callback request after checking that
+// the provider didn't return an error and that the state matches the one kept
+// in the cookie, which ties the callback to the browser that started the login.
+func CallbackState(r *http.Request, cookieName string) (string, error) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return "", fmt.Errorf("provider returned error %v", e)
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(cookieName)
+	if err != nil || state == "" ||
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return "", ErrStateMismatch
+	}
+	return state, nil
+}
+
+// Identity is the user as reported by a verified ID token.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// Exchange trades the authorization code from the callback for an ID token
+// and verifies it.
+func (p *Provider) Exchange(ctx context.Context, code string, s LoginState) (Identity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientId},
+		"code_verifier": {s.CodeVerifier},
+	}
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", p.TokenEndpoint, strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("token endpoint: unexpected status %v", resp.StatusCode)
+	}
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return Identity{}, err
+	}
+	if tokens.IdToken == "" {
+		return Identity{}, fmt.Errorf("%w: missing from token response", ErrInvalidToken)
+	}
+	return p.verifyIdToken(ctx, tokens.IdToken, s.Nonce)
+}
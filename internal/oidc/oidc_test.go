@@ -0,0 +1,376 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientId    = "sudoku"
+	testRedirectURL = "https://www.example.com/login/oidc/fake/callback"
+)
+
+// fakeIdP is an identity provider serving discovery, keys and a token
+// endpoint. Codes are issued by authorize, which stands in for the user
+// logging in at the provider.
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	ecKey  *ecdsa.PrivateKey
+	rsaKey *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+type authorization struct {
+	codeChallenge string
+	claims        map[string]any
+	// signing algorithm and key of the ID token
+	alg string
+	key crypto.Signer
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{t: t, ecKey: ecKey, rsaKey: rsaKey, codes: map[string]authorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.issuer(),
+			"authorization_endpoint": idp.issuer() + "/authorize",
+			"token_endpoint":         idp.issuer() + "/token",
+			"jwks_uri":               idp.issuer() + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{
+				"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256",
+				"x": b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y": b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+			{
+				"kty": "RSA", "kid": "rsa", "use": "sig",
+				"n": b64(rsaKey.N.Bytes()),
+				"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+		}})
+	})
+	mux.HandleFunc("POST /token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) issuer() string {
+	return idp.server.URL
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (idp *fakeIdP) validClaims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            idp.issuer(),
+		"sub":            "subject-1",
+		"aud":            testClientId,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+}
+
+// authorize reads the request sent by the user's browser from authURL and
+// returns a code for an ID token with the claims. modify can change the
+// token before it is issued.
+func (idp *fakeIdP) authorize(authURL string, modify func(a *authorization)) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("client_id") != testClientId || q.Get("redirect_uri") != testRedirectURL ||
+		q.Get("code_challenge_method") != "S256" {
+		idp.t.Fatalf("unexpected authorization request %v", authURL)
+	}
+	a := authorization{
+		codeChallenge: q.Get("code_challenge"),
+		claims:        idp.validClaims(q.Get("nonce")),
+		alg:           "ES256",
+		key:           idp.ecKey,
+	}
+	if modify != nil {
+		modify(&a)
+	}
+	code := b64([]byte(q.Get("state")))
+	idp.mu.Lock()
+	idp.codes[code] = a
+	idp.mu.Unlock()
+	return code
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	idp.mu.Lock()
+	a, ok := idp.codes[r.Form.Get("code")]
+	delete(idp.codes, r.Form.Get("code"))
+	idp.mu.Unlock()
+	verifierHash := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || r.Form.Get("grant_type") != "authorization_code" ||
+		r.Form.Get("client_id") != testClientId ||
+		r.Form.Get("redirect_uri") != testRedirectURL ||
+		b64(verifierHash[:]) != a.codeChallenge {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     signToken(idp.t, a.alg, a.key, a.claims),
+	})
+}
+
+func signToken(t *testing.T, alg string, key crypto.Signer, claims map[string]any) string {
+	kid := "ec"
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		kid = "rsa"
+	}
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64(header) + "." + b64(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + b64(sig)
+}
+
+func newTestProvider(t *testing.T, idp *fakeIdP) *Provider {
+	p, err := NewProvider(
+		context.Background(),
+		Config{
+			Name:        "fake",
+			Issuer:      idp.issuer(),
+			ClientId:    testClientId,
+			RedirectURL: testRedirectURL,
+		},
+		idp.server.Client(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// login runs the whole flow and returns the result of the code exchange.
+func login(t *testing.T, idp *fakeIdP, modify func(a *authorization)) (Identity, error) {
+	p := newTestProvider(t, idp)
+	state, err := NewLoginState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(p.AuthURL(state), modify)
+	return p.Exchange(context.Background(), code, state)
+}
+
+func TestLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	for _, alg := range []string{"ES256", "RS256"} {
+		t.Run(alg, func(t *testing.T) {
+			identity, err := login(t, idp, func(a *authorization) {
+				if alg == "RS256" {
+					a.alg, a.key = "RS256", idp.rsaKey
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Identity{Subject: "subject-1", Email: "user@example.com", EmailVerified: true}
+			if identity != want {
+				t.Errorf("got %+v, want %+v", identity, want)
+			}
+		})
+	}
+}
+
+func TestLoginRejectsInvalidTokens(t *testing.T) {
+	idp := newFakeIdP(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		modify func(a *authorization)
+	}{
+		{"bad signature", func(a *authorization) { a.key = otherKey }},
+		{"key of another algorithm", func(a *authorization) { a.alg, a.key = "RS256", otherKey }},
+		{"wrong audience", func(a *authorization) { a.claims["aud"] = "someone-else" }},
+		{"audience of several clients without azp", func(a *authorization) {
+			a.claims["aud"] = []string{"someone-else", testClientId}
+		}},
+		{"wrong issuer", func(a *authorization) { a.claims["iss"] = "https://evil.example.com" }},
+		{"expired", func(a *authorization) {
+			a.claims["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix()
+		}},
+		{"issued in the future", func(a *authorization) {
+			a.claims["iat"] = time.Now().Add(clockSkew + time.Minute).Unix()
+		}},
+		{"nonce mismatch", func(a *authorization) { a.claims["nonce"] = "other-nonce" }},
+		{"missing subject", func(a *authorization) { delete(a.claims, "sub") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := login(t, idp, test.modify)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestLoginRejectsUnsignedToken(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := newTestProvider(t, idp)
+	header := b64([]byte(`{"alg":"none","kid":"ec"}`))
+	payload, err := json.Marshal(idp.validClaims("nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.verifyIdToken(context.Background(), header+"."+b64(payload)+".", "nonce")
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestLoginRejectsWrongCodeVerifier(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := newTestProvider(t, idp)
+	state, err := NewLoginState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(p.AuthURL(state), nil)
+	state.CodeVerifier = "stolen-code-used-elsewhere"
+	if _, err := p.Exchange(context.Background(), code, state); err == nil {
+		t.Error("exchange succeeded with a wrong code verifier")
+	}
+}
+
+func TestDiscoveryRejectsWrongIssuer(t *testing.T) {
+	idp := newFakeIdP(t)
+	_, err := NewProvider(
+		context.Background(),
+		Config{
+			Name:        "fake",
+			Issuer:      idp.issuer() + "/other",
+			ClientId:    testClientId,
+			RedirectURL: testRedirectURL,
+		},
+		idp.server.Client(),
+	)
+	if err == nil {
+		t.Error("provider created with a discovery document of another issuer")
+	}
+}
+
+func TestCallbackState(t *testing.T) {
+	const cookieName = "oidc_state"
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		ok     bool
+	}{
+		{"matching", "?state=abc&code=1", "abc", true},
+		{"state mismatch", "?state=abc&code=1", "xyz", false},
+		{"missing cookie", "?state=abc&code=1", "", false},
+		{"missing state", "?code=1", "abc", false},
+		{"empty state and cookie", "?state=&code=1", "", false},
+		{"provider error", "?state=abc&error=access_denied", "abc", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/login/oidc/fake/callback"+test.query, nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cookieName, Value: test.cookie})
+			}
+			state, err := CallbackState(r, cookieName)
+			if test.ok && (err != nil || state != test.cookie) {
+				t.Errorf("got %q, %v, want %q", state, err, test.cookie)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("accepted state %q", state)
+			}
+		})
+	}
+	r := httptest.NewRequest("GET", "/login/oidc/fake/callback?state=abc", nil)
+	r.AddCookie(&http.Cookie{Name: cookieName, Value: "xyz"})
+	if _, err := CallbackState(r, cookieName); !errors.Is(err, ErrStateMismatch) {
+		t.Errorf("got error %v, want %v", err, ErrStateMismatch)
+	}
+}
+
+func TestAuthURLKeepsQuery(t *testing.T) {
+	p := &Provider{Config: Config{
+		ClientId:              testClientId,
+		RedirectURL:           testRedirectURL,
+		Scopes:                []string{"openid", "email"},
+		AuthorizationEndpoint: "https://idp.example.com/authorize?tenant=1",
+	}}
+	authURL := p.AuthURL(LoginState{State: "s", Nonce: "n", CodeVerifier: "v"})
+	if !strings.HasPrefix(authURL, "https://idp.example.com/authorize?tenant=1&") {
+		t.Errorf("unexpected URL %v", authURL)
+	}
+}
@@ -0,0 +1,248 @@
+// Package passhash hashes passwords for storage. Hashes carry their scheme
+// and parameters, so the scheme can be changed while old hashes keep working
+// and get replaced on the next login.
+//
+// Supported formats:
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>   (PHC string format)
+//	$bcrypt-sha256$2a$12$...                         (bcrypt of base64(sha256(password)))
+//	$2a$10$...                                       (plain bcrypt, legacy)
+//
+// Plain bcrypt ignores everything past 72 bytes. The bcrypt-sha256 format
+// hashes the password first so that long passwords are not truncated.
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Scheme string
+
+const (
+	Argon2id     Scheme = "argon2id"
+	BcryptSHA256 Scheme = "bcrypt-sha256"
+)
+
+type Params struct {
+	Scheme Scheme
+	// bcrypt
+	Cost int
+	// argon2id
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// Default follows the OWASP recommendation for argon2id, a hash takes a few
+// tens of milliseconds and 19 MiB of memory.
+var Default = Params{Scheme: Argon2id, Time: 2, Memory: 19 * 1024, Threads: 1}
+
+// Current are the parameters new hashes are created with. Set it before
+// hashing anything, e.g. with ParseParams.
+var Current = Default
+
+// ParseParams parses parameters like "argon2id,m=65536,t=3,p=2" or
+// "bcrypt-sha256,cost=12". Parameters that are not given keep their defaults.
+func ParseParams(s string) (Params, error) {
+	fields := strings.Split(s, ",")
+	var p Params
+	switch Scheme(fields[0]) {
+	case Argon2id:
+		p = Default
+	case BcryptSHA256:
+		p = Params{Scheme: BcryptSHA256, Cost: bcrypt.DefaultCost}
+	default:
+		return p, fmt.Errorf("unknown password hash scheme %q", fields[0])
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid password hash parameter %q", field)
+		}
+		switch {
+		case p.Scheme == BcryptSHA256 && key == "cost":
+			p.Cost = int(n)
+		case p.Scheme == Argon2id && key == "t":
+			p.Time = uint32(n)
+		case p.Scheme == Argon2id && key == "m":
+			p.Memory = uint32(n)
+		case p.Scheme == Argon2id && key == "p" && n <= 255:
+			p.Threads = uint8(n)
+		default:
+			return p, fmt.Errorf("invalid password hash parameter %q", field)
+		}
+	}
+	if p.Scheme == BcryptSHA256 && (p.Cost < bcrypt.MinCost || p.Cost > bcrypt.MaxCost) {
+		return p, fmt.Errorf("bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if p.Scheme == Argon2id && (p.Time < 1 || p.Memory < 8*uint32(p.Threads) || p.Threads < 1) {
+		return p, errors.New("invalid argon2id parameters")
+	}
+	return p, nil
+}
+
+var b64 = base64.RawStdEncoding
+
+func preHash(pass string) []byte {
+	sum := sha256.Sum256([]byte(pass))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// Hash hashes the password with the Current parameters.
+func Hash(pass string) (string, error) {
+	return hashWith(Current, pass)
+}
+
+func hashWith(p Params, pass string) (string, error) {
+	switch p.Scheme {
+	case Argon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(pass), salt, p.Time, p.Memory, p.Threads, 32)
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.Memory, p.Time, p.Threads, b64.EncodeToString(salt), b64.EncodeToString(key),
+		), nil
+	case BcryptSHA256:
+		hash, err := bcrypt.GenerateFromPassword(preHash(pass), p.Cost)
+		if err != nil {
+			return "", err
+		}
+		return "$" + string(BcryptSHA256) + string(hash), nil
+	default:
+		return "", fmt.Errorf("can't hash with scheme %q", p.Scheme)
+	}
+}
+
+var errMalformed = errors.New("malformed password hash")
+
+type argon2Hash struct {
+	params Params
+	salt   []byte
+	key    []byte
+}
+
+func parseArgon2(hash string) (argon2Hash, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != string(Argon2id) {
+		return argon2Hash{}, errMalformed
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2Hash{}, errMalformed
+	}
+	h := argon2Hash{params: Params{Scheme: Argon2id}}
+	_, err := fmt.Sscanf(
+		parts[3], "m=%d,t=%d,p=%d", &h.params.Memory, &h.params.Time, &h.params.Threads,
+	)
+	if err != nil || h.params.Time < 1 || h.params.Threads < 1 {
+		return argon2Hash{}, errMalformed
+	}
+	if h.salt, err = b64.DecodeString(parts[4]); err != nil {
+		return argon2Hash{}, errMalformed
+	}
+	if h.key, err = b64.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return argon2Hash{}, errMalformed
+	}
+	return h, nil
+}
+
+// MinVerifyTime is the least time Verify and VerifyDummy take. Hashes of
+// different schemes and parameters take different times to check, e.g. legacy
+// bcrypt about 100ms and argon2id with the Default parameters a few tens of
+// milliseconds, which would reveal what kind of hash an account has, or that
+// it has none. Set it above the time of the slowest hash in use, 0 turns the
+// padding off.
+var MinVerifyTime = 250 * time.Millisecond
+
+func padVerify(start time.Time) {
+	time.Sleep(MinVerifyTime - time.Since(start))
+}
+
+// Verify checks the password against the hash. needsRehash is true when the
+// password is correct but the hash doesn't use the Current parameters, the
+// caller should then store a new hash from Hash.
+func Verify(hash, pass string) (ok bool, needsRehash bool) {
+	defer padVerify(time.Now())
+	return verify(hash, pass)
+}
+
+func verify(hash, pass string) (ok bool, needsRehash bool) {
+	switch {
+	case strings.HasPrefix(hash, "$"+string(Argon2id)+"$"):
+		h, err := parseArgon2(hash)
+		if err != nil {
+			return false, false
+		}
+		key := argon2.IDKey([]byte(pass), h.salt, h.params.Time, h.params.Memory, h.params.Threads, uint32(len(h.key)))
+		if subtle.ConstantTimeCompare(key, h.key) != 1 {
+			return false, false
+		}
+		return true, h.params != Current
+
+	case strings.HasPrefix(hash, "$"+string(BcryptSHA256)+"$"):
+		inner := []byte(strings.TrimPrefix(hash, "$"+string(BcryptSHA256)))
+		if bcrypt.CompareHashAndPassword(inner, preHash(pass)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost(inner)
+		return true, err != nil || Current != Params{Scheme: BcryptSHA256, Cost: cost}
+
+	case strings.HasPrefix(hash, "$2"):
+		// Legacy hashes were created from the first 72 bytes of the password.
+		legacy := pass
+		if len(legacy) > 72 {
+			legacy = legacy[:72]
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(legacy)) != nil {
+			return false, false
+		}
+		return true, true
+
+	default:
+		// e.g. the empty hash of users without a password, they have to cost
+		// as much as a real hash
+		verifyDummy()
+		return false, false
+	}
+}
+
+var dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// VerifyDummy takes as long as Verify. It is used when there is no user to
+// check the password of, so that response times don't reveal which emails
+// are registered.
+func VerifyDummy() {
+	defer padVerify(time.Now())
+	verifyDummy()
+}
+
+// verifyDummy verifies a password hashed with the Current parameters.
+func verifyDummy() {
+	dummyHash.once.Do(func() {
+		dummyHash.hash, _ = Hash("dummy password")
+	})
+	if dummyHash.hash == "" {
+		return
+	}
+	verify(dummyHash.hash, "not the dummy password")
+}
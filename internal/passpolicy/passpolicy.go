@@ -0,0 +1,165 @@
+// Package passpolicy decides which passwords users may choose.
+package passpolicy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Violation says why a password was rejected. Code is meant for clients to
+// show their own message, Message is a default one.
+type Violation struct {
+	Code    string
+	Message string
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+var (
+	ErrTooShort = &Violation{Code: "password_too_short", Message: "Password too short."}
+	ErrTooLong  = &Violation{Code: "password_too_long", Message: "Password too long."}
+	ErrCommon   = &Violation{Code: "password_common", Message: "Password too common."}
+	ErrBreached = &Violation{Code: "password_breached", Message: "Password found in a data breach."}
+)
+
+type Policy struct {
+	// Lengths are counted in characters.
+	MinLen int
+	MaxLen int
+	// Lowercase passwords that are not allowed.
+	Banned map[string]struct{}
+	// Optional, nil to skip the check.
+	Breached *BreachedList
+}
+
+//go:embed common-passwords.txt
+var commonPasswords string
+
+// Default allows passwords of 8 to 128 characters, except for a short list of
+// the most common ones.
+func Default() Policy {
+	banned, _ := readBanned(strings.NewReader(commonPasswords))
+	return Policy{MinLen: 8, MaxLen: 128, Banned: banned}
+}
+
+func readBanned(r io.Reader) (map[string]struct{}, error) {
+	banned := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			banned[line] = struct{}{}
+		}
+	}
+	return banned, scanner.Err()
+}
+
+// AddBanned bans passwords listed one per line in the file, in addition to
+// the ones already banned.
+func (p *Policy) AddBanned(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	banned, err := readBanned(f)
+	if err != nil {
+		return err
+	}
+	if p.Banned == nil {
+		p.Banned = banned
+		return nil
+	}
+	for pass := range banned {
+		p.Banned[pass] = struct{}{}
+	}
+	return nil
+}
+
+// Check returns a *Violation if the password is not allowed, or another
+// error if the breached password list couldn't be read.
+func (p Policy) Check(pass string) error {
+	length := utf8.RuneCountInString(pass)
+	if length < p.MinLen {
+		return ErrTooShort
+	}
+	if p.MaxLen > 0 && length > p.MaxLen {
+		return ErrTooLong
+	}
+	if _, ok := p.Banned[strings.ToLower(pass)]; ok {
+		return ErrCommon
+	}
+	if p.Breached != nil {
+		found, err := p.Breached.Contains(pass)
+		if err != nil {
+			return err
+		}
+		if found {
+			return ErrBreached
+		}
+	}
+	return nil
+}
+
+// BreachedList looks passwords up in a file of sorted, concatenated SHA-1
+// hashes, 20 bytes each, without loading it into memory. Such a file can be
+// created from the Pwned Passwords list with cmd/breached-passwords.
+type BreachedList struct {
+	file  *os.File
+	count int64
+}
+
+const hashSize = sha1.Size
+
+func OpenBreachedList(fileName string) (*BreachedList, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size()%hashSize != 0 {
+		f.Close()
+		return nil, fmt.Errorf("%v: size is not a multiple of %v bytes", fileName, hashSize)
+	}
+	return &BreachedList{file: f, count: info.Size() / hashSize}, nil
+}
+
+func (l *BreachedList) Close() error {
+	return l.file.Close()
+}
+
+// Contains binary searches the file for the hash of the password. ReadAt is
+// safe for concurrent use so no locking is needed.
+func (l *BreachedList) Contains(pass string) (bool, error) {
+	target := sha1.Sum([]byte(pass))
+	var buf [hashSize]byte
+	lo, hi := int64(0), l.count
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if _, err := l.file.ReadAt(buf[:], mid*hashSize); err != nil {
+			return false, err
+		}
+		switch bytes.Compare(buf[:], target[:]) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Postgres keeps buckets in the rate_limit_buckets table so that limits are
+// shared by all instances using the same database. It takes a pool since
+// requests are limited concurrently and a single connection can only run one
+// query at a time.
+type Postgres struct {
+	conn *pgxpool.Pool
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func NewPostgres(conn *pgxpool.Pool) *Postgres {
+	return &Postgres{conn: conn, lastPrune: time.Now()}
+}
+
+func (p *Postgres) prune(ctx context.Context) error {
+	p.mu.Lock()
+	if time.Since(p.lastPrune) < pruneInterval {
+		p.mu.Unlock()
+		return nil
+	}
+	p.lastPrune = time.Now()
+	p.mu.Unlock()
+
+	_, err := p.conn.Exec(
+		ctx,
+		`DELETE FROM rate_limit_buckets WHERE updated_at < $1`,
+		time.Now().Add(-pruneAfter),
+	)
+	return err
+}
+
+func (p *Postgres) Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	if err := p.prune(ctx); err != nil {
+		return false, 0, err
+	}
+
+	var tokens float64
+	err := p.conn.QueryRow(
+		ctx,
+		`INSERT INTO rate_limit_buckets AS b (key, tokens, updated_at)
+        VALUES ($1, $2, now())
+        ON CONFLICT (key) DO UPDATE
+            SET tokens = LEAST(
+                    $2,
+                    b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at)::double precision / $3
+                ),
+                updated_at = now()
+        RETURNING tokens`,
+		key, float64(limit.Burst), limit.Every.Seconds(),
+	).Scan(&tokens)
+	if err != nil {
+		return false, 0, err
+	}
+	if tokens < 1 {
+		return false, time.Duration((1 - tokens) * float64(limit.Every)), nil
+	}
+
+	// Taking a token is a separate statement so that concurrent requests
+	// can't take the same one.
+	ct, err := p.conn.Exec(
+		ctx,
+		`UPDATE rate_limit_buckets SET tokens = tokens - 1 WHERE key = $1 AND tokens >= 1`,
+		key,
+	)
+	if err != nil {
+		return false, 0, err
+	}
+	if ct.RowsAffected() == 0 {
+		return false, limit.Every, nil
+	}
+	return true, 0, nil
+}
@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oskarrrrrrr/sudoku-web/internal/emailaddr"
+)
+
+// Limit of a token bucket. Burst requests can be made at once and a single
+// request is regained every Every.
+type Limit struct {
+	Burst int
+	Every time.Duration
+}
+
+// ParseLimit parses a limit written as "<burst>/<every>", e.g. "10/1m" allows
+// 10 requests at once and another one every minute.
+func ParseLimit(s string) (Limit, error) {
+	rawBurst, rawEvery, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected <burst>/<every>", s)
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(rawBurst))
+	if err != nil || burst < 1 {
+		return Limit{}, fmt.Errorf("invalid burst in limit %q", s)
+	}
+	every, err := time.ParseDuration(strings.TrimSpace(rawEvery))
+	if err != nil || every <= 0 {
+		return Limit{}, fmt.Errorf("invalid interval in limit %q", s)
+	}
+	return Limit{Burst: burst, Every: every}, nil
+}
+
+// Buckets unused for this long are dropped, they are full by then.
+const pruneAfter = 24 * time.Hour
+
+const pruneInterval = 10 * time.Minute
+
+// Retry-After in seconds sent when the limiter fails.
+const unavailableRetryAfter = 5
+
+type Limiter interface {
+	// Allow takes a token from the bucket identified by key. If the bucket is
+	// empty it returns false and the time after which a token will be available.
+	Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+}
+
+// KeyFunc returns the key a request is limited by. Requests for which ok is
+// false are not limited by the rule.
+type KeyFunc func(r *http.Request) (key string, ok bool)
+
+type Rule struct {
+	// Name separates buckets of different rules using the same keys.
+	Name  string
+	Key   KeyFunc
+	Limit Limit
+}
+
+// Middleware responds with 429 Too Many Requests when any of the rules is
+// exceeded. When the limiter fails the request is rejected with 503 Service
+// Unavailable, letting it through would turn off the limits whenever the
+// storage is down or overloaded.
+func Middleware(limiter Limiter, rules []Rule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range rules {
+			key, ok := rule.Key(r)
+			if !ok {
+				continue
+			}
+			allowed, retryAfter, err := limiter.Allow(r.Context(), rule.Name+":"+key, rule.Limit)
+			if err != nil {
+				log.Printf("ERR: Rate limiter failed: %v\n", err)
+				w.Header().Set("Retry-After", strconv.Itoa(unavailableRetryAfter))
+				http.Error(w, "Service unavailable. Try again later.", http.StatusServiceUnavailable)
+				return
+			}
+			if !allowed {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				http.Error(w, "Too many requests. Try again later.", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ByIP limits requests by the client IP. IPv6 addresses are grouped by /64
+// since that is what a single client usually gets.
+//
+// trustedProxies is the number of reverse proxies in front of the server
+// that append the address they got the request from to X-Forwarded-For. The
+// client is the entry added by the outermost of them, anything before it
+// could have been sent by the client. With 0 the header is ignored, it must
+// be 0 when clients can reach the server directly.
+func ByIP(trustedProxies int) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		addr := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); trustedProxies > 0 && forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			addr = strings.TrimSpace(hops[max(len(hops)-trustedProxies, 0)])
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return addr, true
+		}
+		if ip.To4() == nil {
+			ip = ip.Mask(net.CIDRMask(64, 128))
+		}
+		return ip.String(), true
+	}
+}
+
+// maxBodySize limits how much of a request body is read to find a key.
+const maxBodySize = 1 << 16
+
+// ByJSONField limits requests by a string field of a JSON request body,
+// passed through normalize so that different spellings of one value share a
+// bucket. The body is left intact for the handler.
+func ByJSONField(field string, normalize func(string) string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if err != nil {
+			return "", false
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+		var fields map[string]any
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return "", false
+		}
+		value, ok := fields[field].(string)
+		value = normalize(value)
+		if !ok || value == "" {
+			return "", false
+		}
+		return value, true
+	}
+}
+
+// EmailKey normalizes an email address for ByJSONField. Addresses are
+// compared as the handlers compare them, after emailaddr.Normalize and
+// ignoring case. Invalid ones are only trimmed and lowercased, the handlers
+// reject them anyway.
+func EmailKey(address string) string {
+	if normalized, err := emailaddr.Normalize(address); err == nil {
+		address = normalized
+	}
+	return strings.ToLower(strings.TrimSpace(address))
+}
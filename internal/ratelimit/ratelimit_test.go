@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestByIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies int
+		remoteAddr     string
+		forwarded      string
+		want           string
+	}{
+		{"direct", 0, "192.0.2.1:1234", "", "192.0.2.1"},
+		{"direct ignores header", 0, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"ipv6 grouped by /64", 0, "[2001:db8:1:2:3:4:5:6]:1234", "", "2001:db8:1:2::"},
+		{"proxy", 1, "127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"proxy ignores spoofed hops", 1, "127.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"proxy without header", 1, "127.0.0.1:1234", "", "127.0.0.1"},
+		{"two proxies", 2, "127.0.0.1:1234", "203.0.113.9, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"two proxies short header", 2, "127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			key, ok := ByIP(tt.trustedProxies)(r)
+			if !ok || key != tt.want {
+				t.Errorf("key = %q, %v, want %q", key, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestByJSONFieldEmail(t *testing.T) {
+	keyFunc := ByJSONField("email", EmailKey)
+	key := func(body string) (string, bool) {
+		r := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+		key, ok := keyFunc(r)
+		rest, err := io.ReadAll(r.Body)
+		if err != nil || string(rest) != body {
+			t.Errorf("body = %q, %v, want it left intact", rest, err)
+		}
+		return key, ok
+	}
+
+	want, ok := key(`{"email": "user@xn--bcher-kva.example"}`)
+	if !ok {
+		t.Fatal("no key")
+	}
+	for _, email := range []string{
+		"User@Bücher.example",
+		" user@BÜCHER.EXAMPLE ",
+		"user@ｂücher．example",
+		"USER@xn--bcher-kva.example",
+	} {
+		got, ok := key(`{"email": "` + email + `", "password": "secret"}`)
+		if !ok || got != want {
+			t.Errorf("key of %q = %q, %v, want %q", email, got, ok, want)
+		}
+	}
+
+	for _, body := range []string{`{"email": ""}`, `{"email": 1}`, `{}`, `not json`} {
+		if got, ok := key(body); ok {
+			t.Errorf("key of %v = %q, want none", body, got)
+		}
+	}
+}
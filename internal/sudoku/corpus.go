@@ -0,0 +1,164 @@
+package sudoku
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type sudokuKey struct {
+	size  int
+	hints int
+}
+
+// Corpus holds the sudokus served by the API grouped by size and the number
+// of hints, along with the difficulty tiers they are served in.
+// It is safe for concurrent use.
+type Corpus struct {
+	mu           sync.RWMutex
+	sudokus      map[sudokuKey][]Sudoku
+	difficulties []Difficulty
+	// Sudokus served to anyone since the server started. It's only kept in
+	// memory: after a restart every sudoku counts as unserved again, and each
+	// instance counts only what it served itself. It decides when
+	// ReplenishPool generates more and what Stats reports, the history of
+	// each user is in played_sudokus.
+	served map[string]bool
+}
+
+func groupSudokus(sudokus []Sudoku) map[sudokuKey][]Sudoku {
+	grouped := make(map[sudokuKey][]Sudoku)
+	for _, sudoku := range sudokus {
+		key := sudokuKey{size: sudoku.size, hints: sudoku.hints}
+		grouped[key] = append(grouped[key], sudoku)
+	}
+	return grouped
+}
+
+func NewCorpus(sudokus []Sudoku, difficulties []Difficulty) *Corpus {
+	return &Corpus{
+		sudokus:      groupSudokus(sudokus),
+		difficulties: difficulties,
+		served:       make(map[string]bool),
+	}
+}
+
+// Replace swaps the contents of the corpus at once, concurrent readers see
+// either the old or the new contents.
+func (c *Corpus) Replace(sudokus []Sudoku, difficulties []Difficulty) {
+	grouped := groupSudokus(sudokus)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sudokus = grouped
+	c.difficulties = difficulties
+}
+
+// Difficulties returns the difficulty tiers in display order.
+func (c *Corpus) Difficulties() []Difficulty {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.difficulties
+}
+
+func (c *Corpus) withDifficulty(diff Difficulty) []Sudoku {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var sudokus []Sudoku
+	for hints := diff.MinHints; hints <= diff.MaxHints; hints++ {
+		sudokus = append(sudokus, c.sudokus[sudokuKey{size: diff.Size, hints: hints}]...)
+	}
+	return sudokus
+}
+
+func (c *Corpus) add(sudoku Sudoku) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := sudokuKey{size: sudoku.size, hints: sudoku.hints}
+	c.sudokus[key] = append(c.sudokus[key], sudoku)
+}
+
+func (c *Corpus) contains(sudoku Sudoku) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, s := range c.sudokus[sudokuKey{size: sudoku.size, hints: sudoku.hints}] {
+		if s.value == sudoku.value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Corpus) markServed(sudoku Sudoku) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.served[sudoku.value] = true
+}
+
+func (c *Corpus) unserved(diff Difficulty) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	count := 0
+	for hints := diff.MinHints; hints <= diff.MaxHints; hints++ {
+		for _, sudoku := range c.sudokus[sudokuKey{size: diff.Size, hints: hints}] {
+			if !c.served[sudoku.value] {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// ReloadCorpus reads sudokus and difficulties again and replaces the contents
+// of the corpus with them. Nothing is replaced if any of them is invalid.
+func ReloadCorpus(conn *pgxpool.Pool, ctx context.Context, corpus *Corpus, fileName string) error {
+	sudokus, err := LoadSudokus(fileName)
+	if err != nil {
+		return err
+	}
+	difficulties, err := LoadDifficulties(conn, ctx)
+	if err != nil {
+		return err
+	}
+	if len(difficulties) == 0 {
+		return errors.New("no difficulties defined")
+	}
+	corpus.Replace(sudokus, difficulties)
+	log.Printf("Reloaded %v sudokus and %v difficulties\n", len(sudokus), len(difficulties))
+	return nil
+}
+
+// DifficultyStats describes the sudokus available in a difficulty tier.
+type DifficultyStats struct {
+	Difficulty
+	Total int `json:"total"`
+	// not served to anyone since the server started, see Corpus.served
+	Unserved int `json:"unserved"`
+}
+
+// Stats returns the number of sudokus in each difficulty tier.
+func (c *Corpus) Stats() []DifficultyStats {
+	var stats []DifficultyStats
+	for _, diff := range c.Difficulties() {
+		stats = append(stats, DifficultyStats{
+			Difficulty: diff,
+			Total:      len(c.withDifficulty(diff)),
+			Unserved:   c.unserved(diff),
+		})
+	}
+	return stats
+}
+
+// CountBySize returns the number of sudokus of each size, including the ones
+// that don't belong to any difficulty tier.
+func (c *Corpus) CountBySize() map[int]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sizes := make(map[int]int)
+	for key, sudokus := range c.sudokus {
+		sizes[key.size] += len(sudokus)
+	}
+	return sizes
+}
@@ -0,0 +1,91 @@
+package sudoku
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Difficulty is a tier of sudokus of a given size defined by a range of hints.
+type Difficulty struct {
+	Name     string `json:"name"`
+	Size     int    `json:"size"`
+	MinHints int    `json:"minHints"`
+	MaxHints int    `json:"maxHints"`
+}
+
+func (d Difficulty) matches(sudoku Sudoku) bool {
+	return d.Size == sudoku.size &&
+		d.MinHints <= sudoku.hints && sudoku.hints <= d.MaxHints
+}
+
+func difficultiesWithSize(difficulties []Difficulty, size int) []Difficulty {
+	var result []Difficulty
+	for _, d := range difficulties {
+		if d.Size == size {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// LoadDifficulties reads difficulty tiers from the database in display order.
+func LoadDifficulties(conn *pgxpool.Pool, ctx context.Context) ([]Difficulty, error) {
+	rows, err := conn.Query(
+		ctx,
+		`SELECT name, size, min_hints, max_hints FROM difficulties
+        ORDER BY size, display_order, name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Difficulty, error) {
+		var d Difficulty
+		err := row.Scan(&d.Name, &d.Size, &d.MinHints, &d.MaxHints)
+		return d, err
+	})
+}
+
+type parseError struct {
+	msg string
+}
+
+func (err parseError) Error() string {
+	return err.msg
+}
+
+func validateDifficulty(
+	difficulties []Difficulty, value string, default_ Difficulty,
+) (Difficulty, *parseError) {
+	if value == "" {
+		return default_, nil
+	}
+	names := make([]string, len(difficulties))
+	for i, d := range difficulties {
+		if d.Name == value {
+			return d, nil
+		}
+		names[i] = "'" + d.Name + "'"
+	}
+	msg := "Invalid difficulty. Expected one of: " + strings.Join(names, ", ") + ". " +
+		"Got: '" + value + "'"
+	return default_, &parseError{msg: msg}
+}
+
+func ListDifficulties(corpus *Corpus, w http.ResponseWriter, r *http.Request) {
+	size, err := validateSize(r.URL.Query().Get("size"))
+	if err != nil {
+		http.Error(w, err.msg, http.StatusUnprocessableEntity)
+		return
+	}
+	difficulties := difficultiesWithSize(corpus.Difficulties(), size)
+	if difficulties == nil {
+		difficulties = []Difficulty{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(difficulties)
+}
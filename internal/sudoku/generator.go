@@ -0,0 +1,327 @@
+package sudoku
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+func checkSudokuRules(n int, sudoku [][]int) bool {
+	seen := make([]bool, n*n)
+
+	clearSeen := func() {
+		for i := range seen {
+			seen[i] = false
+		}
+	}
+
+	for _, row := range sudoku {
+		clearSeen()
+		for _, v := range row {
+			if v == 0 {
+				continue
+			}
+			if seen[v-1] {
+				return false
+			}
+			seen[v-1] = true
+		}
+	}
+
+	for colIdx := 0; colIdx < n*n; colIdx++ {
+		clearSeen()
+		for _, row := range sudoku {
+			v := row[colIdx]
+			if v == 0 {
+				continue
+			}
+			if seen[v-1] {
+				return false
+			}
+			seen[v-1] = true
+		}
+	}
+
+	for startRowIdx := 0; startRowIdx < n*n; startRowIdx += n {
+		for startColIdx := 0; startColIdx < n*n; startColIdx += n {
+			clearSeen()
+			for row := 0; row < n; row++ {
+				for col := 0; col < n; col++ {
+					v := sudoku[startRowIdx+row][startColIdx+col]
+					if v == 0 {
+						continue
+					}
+					if seen[v-1] {
+						return false
+					}
+					seen[v-1] = true
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func copySudoku(n int, sudoku [][]int) [][]int {
+	_sudoku := make([][]int, n*n)
+	for rowIdx := range _sudoku {
+		_sudoku[rowIdx] = make([]int, n*n)
+		for colIdx := range _sudoku[rowIdx] {
+			_sudoku[rowIdx][colIdx] = sudoku[rowIdx][colIdx]
+		}
+	}
+	return _sudoku
+}
+
+// CountSolutions finds solutions of the sudoku, stopping after stopAfter of
+// them have been found (-1 to find all).
+func CountSolutions(n int, sudoku [][]int, stopAfter int, random bool) [][][]int {
+	solutions, _ := countSolutions(context.Background(), n, sudoku, stopAfter, random)
+	return solutions
+}
+
+// How many cells are tried between checks whether the search was cancelled.
+const cancelCheckInterval = 1024
+
+// countSolutions works like CountSolutions but gives up with ctx.Err() once
+// ctx is done, the search can take very long for big sudokus.
+func countSolutions(
+	ctx context.Context, n int, sudoku [][]int, stopAfter int, random bool,
+) (solutions [][][]int, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_sudoku := copySudoku(n, sudoku)
+	steps := 0
+
+	rows, cols, uniqueValues := n*n, n*n, n*n
+	tried := make([]bool, rows*cols*uniqueValues)
+
+	triedIdx := func(row, col, value int) int {
+		return (row * cols * uniqueValues) + (col * uniqueValues) + value - 1
+	}
+
+	addTried := func(row, col, value int) {
+		tried[triedIdx(row, col, value)] = true
+	}
+
+	nextNotTried := func(row, col int) int {
+		start := triedIdx(row, col, 1)
+		for i := 0; i < uniqueValues; i++ {
+			if !tried[start+i] {
+				return i + 1
+			}
+		}
+		return 0
+	}
+
+	randomNotTried := func(row, col int) int {
+		untried := 0
+		start := triedIdx(row, col, 1)
+		for i := 0; i < uniqueValues; i++ {
+			if !tried[start+i] {
+				untried++
+			}
+		}
+
+		if untried == 0 {
+			return 0
+		}
+
+		selectedOrd := rand.Intn(untried)
+		for i := 0; i < uniqueValues; i++ {
+			if !tried[start+i] {
+				if selectedOrd == 0 {
+					return i + 1
+				}
+				selectedOrd--
+			}
+		}
+
+		panic("random not tried failed")
+	}
+
+	clearTriedFrom := func(row, col int) {
+		for i := triedIdx(row, col, 1); i < len(tried); i++ {
+			tried[i] = false
+		}
+	}
+
+	nextRowCol := func(row, col int) (int, int, bool) {
+		for r := row; r < n*n; r++ {
+			var startC int
+			if r == row {
+				startC = col
+			} else {
+				startC = 0
+			}
+			for c := startC; c < n*n; c++ {
+				if _sudoku[r][c] == 0 {
+					return r, c, true
+				}
+			}
+		}
+		return 0, 0, false
+	}
+
+	var dfs func(int, int)
+	dfs = func(row, col int) {
+		for {
+			steps++
+			if steps%cancelCheckInterval == 0 && err == nil {
+				err = ctx.Err()
+			}
+			if err != nil {
+				return
+			}
+			var v int
+			if random {
+				v = randomNotTried(row, col)
+			} else {
+				v = nextNotTried(row, col)
+			}
+			if v == 0 {
+				_sudoku[row][col] = 0
+				clearTriedFrom(row, col)
+				return
+			}
+			_sudoku[row][col] = v
+			if checkSudokuRules(n, _sudoku) {
+				r, c, notFull := nextRowCol(row, col)
+				if notFull {
+					dfs(r, c)
+					if len(solutions) == stopAfter || err != nil {
+						return
+					}
+				} else {
+					solutions = append(solutions, copySudoku(n, _sudoku))
+					if len(solutions) == stopAfter {
+						return
+					}
+				}
+			}
+			addTried(row, col, v)
+		}
+	}
+
+	if row, col, notFull := nextRowCol(0, 0); notFull {
+		dfs(row, col)
+	} else {
+		solutions = append(solutions, _sudoku)
+		return
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Generate returns a random n*n x n*n sudoku with the given number of hints
+// and a unique solution, along with the solution.
+func Generate(n, hints int) ([][]int, [][]int) {
+	sudoku, solution, _ := GenerateContext(context.Background(), n, hints)
+	return sudoku, solution
+}
+
+// GenerateContext works like Generate but stops with ctx.Err() once ctx is
+// done. Generating a big sudoku with few hints can take arbitrarily long.
+func GenerateContext(ctx context.Context, n, hints int) ([][]int, [][]int, error) {
+	sudoku := make([][]int, n*n)
+	for rowIdx := range sudoku {
+		sudoku[rowIdx] = make([]int, n*n)
+	}
+	filled, err := countSolutions(ctx, n, sudoku, 1, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	sudoku = filled[0]
+
+	_sudoku := copySudoku(n, sudoku)
+
+	findNthTaken := func(k int, seen [][]bool) (int, int) {
+		for rowIdx, row := range _sudoku {
+			for colIdx, v := range row {
+				if v != 0 && !seen[rowIdx][colIdx] {
+					k--
+				}
+				if k < 0 {
+					return rowIdx, colIdx
+				}
+			}
+		}
+		panic("cant take such elem")
+	}
+
+	var dfs func(int) bool
+	dfs = func(currHints int) bool {
+		if currHints == hints {
+			return true
+		}
+		var seen [][]bool
+		for range sudoku {
+			row := make([]bool, len(sudoku[0]))
+			seen = append(seen, row)
+		}
+		seenCount := 0
+
+		for {
+			if currHints == seenCount || err != nil {
+				return false
+			}
+			targetIdx := rand.Intn(currHints - seenCount)
+			row, col := findNthTaken(targetIdx, seen)
+			seen[row][col] = true
+			seenCount++
+			v := _sudoku[row][col]
+			_sudoku[row][col] = 0
+			var solutions [][][]int
+			solutions, err = countSolutions(ctx, n, _sudoku, 2, true)
+			if err != nil {
+				return false
+			}
+			if len(solutions) == 0 {
+				panic("no solutions found")
+			}
+			if len(solutions) > 1 {
+				_sudoku[row][col] = v
+			} else {
+				if dfs(currHints - 1) {
+					return true
+				}
+				_sudoku[row][col] = v
+			}
+		}
+	}
+
+	dfs(n * n * n * n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return _sudoku, sudoku, nil
+}
+
+func CountHints(sudoku [][]int) int {
+	hints := 0
+	for _, row := range sudoku {
+		for _, v := range row {
+			if v != 0 {
+				hints++
+			}
+		}
+	}
+	return hints
+}
+
+// Encode formats the sudoku the same way it is stored in sudokus.txt.
+func Encode(grid [][]int) string {
+	values := make([]string, 0, len(grid)*len(grid))
+	for _, row := range grid {
+		for _, v := range row {
+			values = append(values, strconv.Itoa(v))
+		}
+	}
+	return strings.Join(values, ",")
+}
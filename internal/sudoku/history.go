@@ -0,0 +1,126 @@
+package sudoku
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// servedAt returns when each sudoku in the user's history was last served to
+// them. Sudokus the user has never been served nor finished are absent from
+// the map. The whole history is read, it's found through the primary key and
+// is much smaller than the corpus, which callers filter it against.
+func servedAt(
+	conn *pgxpool.Pool, ctx context.Context, userId int,
+) (map[string]time.Time, error) {
+	rows, err := conn.Query(
+		ctx,
+		`SELECT sudoku, served_at FROM played_sudokus WHERE user_id = $1`,
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]time.Time)
+	for rows.Next() {
+		var value string
+		var at time.Time
+		if err := rows.Scan(&value, &at); err != nil {
+			return nil, err
+		}
+		seen[value] = at
+	}
+	return seen, rows.Err()
+}
+
+func markServed(conn *pgxpool.Pool, ctx context.Context, userId int, sudoku Sudoku) error {
+	_, err := conn.Exec(
+		ctx,
+		`INSERT INTO played_sudokus (user_id, sudoku) VALUES ($1, $2)
+        ON CONFLICT (user_id, sudoku) DO UPDATE SET served_at = now()`,
+		userId, sudoku.value,
+	)
+	return err
+}
+
+func markFinished(conn *pgxpool.Pool, ctx context.Context, userId int, sudoku Sudoku) error {
+	_, err := conn.Exec(
+		ctx,
+		`INSERT INTO played_sudokus (user_id, sudoku, finished_at) VALUES ($1, $2, now())
+        ON CONFLICT (user_id, sudoku) DO UPDATE SET finished_at = now()`,
+		userId, sudoku.value,
+	)
+	return err
+}
+
+// pickUnseenSudoku picks a random sudoku the user has not been served yet.
+// When all candidates were already served it falls back to the one served
+// longest ago. Failing to read or write the history is not fatal, a random
+// sudoku is served instead.
+func pickUnseenSudoku(
+	conn *pgxpool.Pool, ctx context.Context, userId int, candidates []Sudoku,
+) Sudoku {
+	seen, err := servedAt(conn, ctx, userId)
+	if err != nil {
+		log.Printf("ERR: Failed to read served sudokus of user %v: %v\n", userId, err)
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	var unseen []Sudoku
+	oldest := candidates[0]
+	for _, sudoku := range candidates {
+		at, ok := seen[sudoku.value]
+		if !ok {
+			unseen = append(unseen, sudoku)
+		} else if at.Before(seen[oldest.value]) {
+			oldest = sudoku
+		}
+	}
+
+	picked := oldest
+	if len(unseen) > 0 {
+		picked = unseen[rand.Intn(len(unseen))]
+	}
+	if err := markServed(conn, ctx, userId, picked); err != nil {
+		log.Printf("ERR: Failed to mark sudoku as served to user %v: %v\n", userId, err)
+	}
+	return picked
+}
+
+type finishSudokuRequest struct {
+	Sudoku string `json:"sudoku"`
+}
+
+// FinishSudoku records that the user finished a sudoku, so that it isn't
+// served to them again. The sudoku is sent as served, before shuffling. It
+// doesn't have to be served to the user before, e.g. when it was served on
+// another device before logging in.
+func FinishSudoku(
+	conn *pgxpool.Pool, ctx context.Context, corpus *Corpus, userId int,
+	w http.ResponseWriter, r *http.Request,
+) {
+	var req finishSudokuRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "Failed to parse request.", http.StatusBadRequest)
+		return
+	}
+	sudoku, err := parseSudoku(req.Sudoku)
+	if err != nil || !corpus.contains(sudoku) {
+		http.Error(w, "Unknown sudoku.", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := markFinished(conn, ctx, userId, sudoku); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("ERR: Failed to mark sudoku as finished by user %v: %v\n", userId, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
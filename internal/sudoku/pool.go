@@ -0,0 +1,140 @@
+package sudoku
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+type PoolConfig struct {
+	// Minimum number of sudokus per difficulty that were not served yet.
+	MinUnserved int
+	// How often the stock is checked.
+	Interval time.Duration
+	// Fraction of a single CPU core the generator may use, in (0, 1].
+	CPUBudget float64
+	// Generating a single sudoku is abandoned after this long, some hint
+	// counts take the generator arbitrarily long. 0 for no limit.
+	GenerateTimeout time.Duration
+	// Generated sudokus are appended to this file so they survive restarts.
+	// Empty to keep them only in memory.
+	OutFile string
+}
+
+func (config PoolConfig) validate() error {
+	if config.MinUnserved < 0 {
+		return errors.New("MinUnserved must not be negative")
+	}
+	if config.Interval <= 0 {
+		return errors.New("Interval must be positive")
+	}
+	if !(config.CPUBudget > 0 && config.CPUBudget <= 1) {
+		return fmt.Errorf("CPUBudget must be in (0, 1], got %v", config.CPUBudget)
+	}
+	if config.GenerateTimeout < 0 {
+		return errors.New("GenerateTimeout must not be negative")
+	}
+	return nil
+}
+
+// ReplenishPool keeps generating sudokus in the background whenever the stock
+// of unserved sudokus of some difficulty drops below the configured minimum.
+// It stops when ctx is cancelled, abandoning a sudoku that is being generated
+// at that moment, and closes the returned channel once done.
+func ReplenishPool(
+	ctx context.Context, corpus *Corpus, config PoolConfig,
+) (<-chan struct{}, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			replenish(ctx, corpus, config)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done, nil
+}
+
+func generate(ctx context.Context, config PoolConfig, size, hints int) ([][]int, error) {
+	if config.GenerateTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.GenerateTimeout)
+		defer cancel()
+	}
+	grid, _, err := GenerateContext(ctx, boxSizes[size], hints)
+	return grid, err
+}
+
+func replenish(ctx context.Context, corpus *Corpus, config PoolConfig) {
+	for _, diff := range corpus.Difficulties() {
+		generated := 0
+		for corpus.unserved(diff) < config.MinUnserved {
+			hints := diff.MinHints + rand.Intn(diff.MaxHints-diff.MinHints+1)
+			start := time.Now()
+			grid, err := generate(ctx, config, diff.Size, hints)
+			elapsed := time.Since(start)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				log.Printf(
+					"[WARN] gave up generating a %vx%v sudoku with %v hints after %v",
+					diff.Size, diff.Size, hints, elapsed.Round(time.Second),
+				)
+			} else if addGenerated(corpus, config, diff, grid, hints) {
+				generated++
+			}
+
+			// Stay idle long enough for the generation to fit the CPU budget.
+			idle := time.Duration(float64(elapsed) * (1 - config.CPUBudget) / config.CPUBudget)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(idle):
+			}
+		}
+		if generated > 0 {
+			log.Printf("Generated %v %v %vx%v sudokus\n", generated, diff.Name, diff.Size, diff.Size)
+		}
+	}
+}
+
+// addGenerated adds the sudoku to the corpus if it fits the difficulty.
+func addGenerated(corpus *Corpus, config PoolConfig, diff Difficulty, grid [][]int, hints int) bool {
+	sudoku := Sudoku{size: diff.Size, hints: CountHints(grid), value: Encode(grid)}
+	if !diff.matches(sudoku) {
+		log.Printf("[WARN] generated sudoku has %v hints instead of %v", sudoku.hints, hints)
+		return false
+	}
+	corpus.add(sudoku)
+	if config.OutFile != "" {
+		if err := appendSudoku(config.OutFile, sudoku); err != nil {
+			log.Printf("ERR: Failed to save generated sudoku: %v\n", err)
+		}
+	}
+	return true
+}
+
+func appendSudoku(fileName string, sudoku Sudoku) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(sudoku.value + "\n")
+	return err
+}
@@ -1,108 +1,130 @@
 package sudoku
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Sudoku struct {
+	// number of rows, the sudoku has size*size cells
+	size  int
 	hints int
 	value string
 }
 
-type difficulty int
+// supported sizes mapped to the size of a single box
+var boxSizes = map[int]int{4: 2, 9: 3, 16: 4}
 
-const (
-	easy difficulty = iota
-	medium
-	hard
-)
+const defaultSize = 9
 
-type parseError struct {
-	msg string
-}
-
-func (err parseError) Error() string {
-	return err.msg
-}
-
-func validateDifficulty(value string, default_ difficulty) (difficulty, *parseError) {
-	switch value {
-	case "":
-		return default_, nil
-	case "easy":
-		return easy, nil
-	case "medium":
-		return medium, nil
-	case "hard":
-		return hard, nil
-	default:
-		msg := "Invalid difficulty. Expected one of: 'easy', 'medium', 'hard'. " +
-			"Got: '" + value + "'"
-		return easy, &parseError{msg: msg}
+func validateSize(value string) (int, *parseError) {
+	if value == "" {
+		return defaultSize, nil
 	}
-}
-
-func difficultyToString(diff difficulty) string {
-	switch diff {
-	case easy:
-		return "easy"
-	case medium:
-		return "medium"
-	case hard:
-		return "hard"
-	default:
-		panic("unexpected difficulty value")
+	size, err := strconv.Atoi(value)
+	if _, ok := boxSizes[size]; err != nil || !ok {
+		msg := "Invalid size. Expected one of: '4', '9', '16'. Got: '" + value + "'"
+		return defaultSize, &parseError{msg: msg}
 	}
+	return size, nil
 }
 
-func getSudokuWithDifficulty(sudokus map[int][]Sudoku, difficulty difficulty) Sudoku {
-	var hints int
-	switch difficulty {
-	case easy:
-		hints = 40
-	case medium:
-		hints = 32
-	case hard:
-		hints = 25
-	default:
-		panic("unknown difficulty")
+// parseSudoku parses a single line of sudokus.txt and checks that the hints
+// do not break sudoku rules.
+func parseSudoku(rawSudoku string) (Sudoku, error) {
+	values := strings.Split(rawSudoku, ",")
+	size := int(math.Sqrt(float64(len(values))))
+	boxSize, ok := boxSizes[size]
+	if !ok || size*size != len(values) {
+		return Sudoku{}, fmt.Errorf("unsupported number of cells: %v", len(values))
+	}
+	grid := make([][]int, size)
+	hints := 0
+	for i, value := range values {
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 || v > size {
+			return Sudoku{}, fmt.Errorf("invalid cell value: '%v'", value)
+		}
+		if v != 0 {
+			hints++
+		}
+		grid[i/size] = append(grid[i/size], v)
+	}
+	if !checkSudokuRules(boxSize, grid) {
+		return Sudoku{}, errors.New("hints break sudoku rules")
 	}
-	arr := sudokus[hints]
-	return arr[rand.Intn(len(arr))]
+	return Sudoku{size: size, hints: hints, value: rawSudoku}, nil
 }
 
-func ReadSudokus() map[int][]Sudoku {
-	sudokusText, err := os.ReadFile("sudokus.txt")
+// LoadSudokus reads and validates all sudokus from the file. A single
+// invalid sudoku fails the whole file.
+func LoadSudokus(fileName string) ([]Sudoku, error) {
+	sudokusText, err := os.ReadFile(fileName)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	rawSudokus := strings.Split(strings.Trim(string(sudokusText), "\n"), "\n")
-	sudokus := make(map[int][]Sudoku)
-	for _, rawSudoku := range rawSudokus {
-		// works only for 9x9 sudoku!
-		hints := 81 - strings.Count(rawSudoku, "0")
-		sudoku := Sudoku{hints: hints, value: rawSudoku}
-		if hintsArr, ok := sudokus[hints]; ok {
-			hintsArr = append(hintsArr, sudoku)
-		} else {
-			hintsArr := make([]Sudoku, 0)
-			hintsArr = append(hintsArr, sudoku)
-			sudokus[hints] = hintsArr
+	sudokus := make([]Sudoku, len(rawSudokus))
+	for i, rawSudoku := range rawSudokus {
+		sudokus[i], err = parseSudoku(rawSudoku)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %w", fileName, i+1, err)
 		}
 	}
-	return sudokus
+	return sudokus, nil
 }
 
-func RandomSudoku(sudokus map[int][]Sudoku, w http.ResponseWriter, r *http.Request) {
+// RandomSudoku serves a sudoku of the requested size and difficulty. For logged in
+// users (userId != 0) it prefers sudokus they have not been served before.
+func RandomSudoku(
+	conn *pgxpool.Pool, ctx context.Context, corpus *Corpus, userId int,
+	w http.ResponseWriter, r *http.Request,
+) {
+	size, err := validateSize(r.URL.Query().Get("size"))
+	if err != nil {
+		http.Error(w, err.msg, http.StatusUnprocessableEntity)
+		return
+	}
+	difficulties := difficultiesWithSize(corpus.Difficulties(), size)
+	if len(difficulties) == 0 {
+		http.Error(
+			w, "No difficulties defined for this size.",
+			http.StatusServiceUnavailable,
+		)
+		return
+	}
 	rawDiff := r.URL.Query().Get("difficulty")
-	diff, err := validateDifficulty(rawDiff, difficulty(rand.Intn(3)))
+	diff, err := validateDifficulty(
+		difficulties, rawDiff, difficulties[rand.Intn(len(difficulties))],
+	)
 	if err != nil {
 		http.Error(w, err.msg, http.StatusUnprocessableEntity)
+		return
+	}
+	candidates := corpus.withDifficulty(diff)
+	if len(candidates) == 0 {
+		http.Error(
+			w, "No sudokus available for this difficulty yet.",
+			http.StatusServiceUnavailable,
+		)
+		return
+	}
+	var sudoku Sudoku
+	if userId == 0 {
+		sudoku = candidates[rand.Intn(len(candidates))]
+	} else {
+		sudoku = pickUnseenSudoku(conn, ctx, userId, candidates)
 	}
-	sudoku := getSudokuWithDifficulty(sudokus, diff)
-	body := difficultyToString(diff) + "\n" + sudoku.value
+	corpus.markServed(sudoku)
+	body := diff.Name + "\n" + sudoku.value
 	w.Write([]byte(body))
 }
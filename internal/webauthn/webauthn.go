@@ -0,0 +1,307 @@
+// Package webauthn verifies passkey registrations and logins (WebAuthn Level 2).
+// Attestation statements are not verified, registrations are expected to use
+// the "none" attestation conveyance.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// COSE algorithm identifiers of supported keys.
+const (
+	AlgES256 = -7
+	AlgRS256 = -257
+)
+
+// authenticator data flags
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagAttestedData   = 0x40
+	flagExtensionsData = 0x80
+)
+
+var (
+	ErrInvalid = errors.New("invalid WebAuthn response")
+	// ErrSignCount means that the authenticator counter went backwards, which
+	// suggests that the credential was cloned.
+	ErrSignCount = errors.New("signature counter did not increase")
+)
+
+type RelyingParty struct {
+	// Domain the credentials are scoped to, e.g. example.com.
+	ID   string
+	Name string
+	// Origins the ceremonies may be performed from, e.g. https://www.example.com.
+	Origins []string
+}
+
+// NewChallenge returns a random challenge for a registration or login.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	return challenge, err
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// ChallengeFromClientData returns the challenge the browser signed, so that it
+// can be looked up before the rest of the response is verified.
+func ChallengeFromClientData(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrInvalid, err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data challenge", ErrInvalid)
+	}
+	return challenge, nil
+}
+
+func (rp RelyingParty) checkClientData(clientDataJSON []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrInvalid, err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("%w: client data type %q", ErrInvalid, cd.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: wrong challenge", ErrInvalid)
+	}
+	if !slices.Contains(rp.Origins, cd.Origin) {
+		return fmt.Errorf("%w: origin %q not allowed", ErrInvalid, cd.Origin)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIdHash  []byte
+	flags     byte
+	signCount uint32
+	// only present in registrations
+	credentialId []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	var ad authenticatorData
+	if len(data) < 37 {
+		return ad, fmt.Errorf("%w: authenticator data too short", ErrInvalid)
+	}
+	ad.rpIdHash = data[:32]
+	ad.flags = data[32]
+	ad.signCount = binary.BigEndian.Uint32(data[33:37])
+	rest := data[37:]
+
+	if ad.flags&flagAttestedData != 0 {
+		// AAGUID (16 bytes) and credential id length (2 bytes)
+		if len(rest) < 18 {
+			return ad, fmt.Errorf("%w: attested credential data too short", ErrInvalid)
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return ad, fmt.Errorf("%w: credential id too short", ErrInvalid)
+		}
+		ad.credentialId = rest[:idLen]
+		rest = rest[idLen:]
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return ad, fmt.Errorf("%w: credential public key: %v", ErrInvalid, err)
+		}
+		ad.publicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+	if ad.flags&flagExtensionsData != 0 {
+		_, afterExt, err := decodeCBOR(rest)
+		if err != nil {
+			return ad, fmt.Errorf("%w: extensions: %v", ErrInvalid, err)
+		}
+		rest = afterExt
+	}
+	if len(rest) != 0 {
+		return ad, fmt.Errorf("%w: trailing authenticator data", ErrInvalid)
+	}
+	return ad, nil
+}
+
+// Passkeys replace the password so the user has to be verified by the
+// authenticator, e.g. with a PIN or biometrics, not only be present.
+func (rp RelyingParty) checkAuthenticatorData(ad authenticatorData) error {
+	rpIdHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIdHash, rpIdHash[:]) {
+		return fmt.Errorf("%w: wrong relying party", ErrInvalid)
+	}
+	if ad.flags&flagUserPresent == 0 || ad.flags&flagUserVerified == 0 {
+		return fmt.Errorf("%w: user not verified", ErrInvalid)
+	}
+	return nil
+}
+
+type Credential struct {
+	Id []byte
+	// COSE encoded public key.
+	PublicKey []byte
+	SignCount uint32
+}
+
+// VerifyRegistration checks the response to navigator.credentials.create and
+// returns the new credential.
+func (rp RelyingParty) VerifyRegistration(
+	challenge, clientDataJSON, attestationObject []byte,
+) (Credential, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+
+	obj, rest, err := decodeCBOR(attestationObject)
+	if err != nil || len(rest) != 0 {
+		return Credential{}, fmt.Errorf("%w: attestation object", ErrInvalid)
+	}
+	fields, ok := obj.(map[any]any)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object", ErrInvalid)
+	}
+	authData, ok := fields["authData"].([]byte)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: missing authenticator data", ErrInvalid)
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := rp.checkAuthenticatorData(ad); err != nil {
+		return Credential{}, err
+	}
+	if ad.credentialId == nil {
+		return Credential{}, fmt.Errorf("%w: missing credential", ErrInvalid)
+	}
+	if len(ad.credentialId) > 1023 {
+		return Credential{}, fmt.Errorf("%w: credential id too long", ErrInvalid)
+	}
+	if _, err := parsePublicKey(ad.publicKey); err != nil {
+		return Credential{}, err
+	}
+	return Credential{
+		Id:        ad.credentialId,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyLogin checks the response to navigator.credentials.get made with the
+// given credential. It returns the new signature counter to store.
+func (rp RelyingParty) VerifyLogin(
+	challenge []byte, credential Credential,
+	clientDataJSON, authenticatorDataBytes, signature []byte,
+) (uint32, error) {
+	if err := rp.checkClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthenticatorData(authenticatorDataBytes)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkAuthenticatorData(ad); err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(slices.Clip(authenticatorDataBytes), clientDataHash[:]...)
+	if err := verifySignature(key, signed, signature); err != nil {
+		return 0, err
+	}
+
+	// Authenticators that don't count always send 0.
+	if (ad.signCount != 0 || credential.SignCount != 0) && ad.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+	return ad.signCount, nil
+}
+
+func parsePublicKey(cose []byte) (crypto.PublicKey, error) {
+	v, rest, err := decodeCBOR(cose)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: public key", ErrInvalid)
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: public key", ErrInvalid)
+	}
+	// COSE key parameters, RFC 9053
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: EC2 public key", ErrInvalid)
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("%w: EC2 point not on curve", ErrInvalid)
+		}
+		return key, nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: RSA public key", ErrInvalid)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %v with algorithm %v", ErrInvalid, kty, alg)
+	}
+}
+
+func verifySignature(key crypto.PublicKey, signed, signature []byte) error {
+	hash := sha256.Sum256(signed)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return fmt.Errorf("%w: bad signature", ErrInvalid)
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+			return fmt.Errorf("%w: bad signature", ErrInvalid)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key", ErrInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// Responses of real authenticators captured on webauthn.io, as published in
+// the test suite of github.com/go-webauthn/webauthn.
+const (
+	// none attestation, ES256, user present but not verified
+	realRegistrationChallenge  = "W8GzFU8pGjhoRbWrLDlamAfq_y4S1CZG1VuoeRLARrE"
+	realRegistrationClientData = "eyJjaGFsbGVuZ2UiOiJXOEd6RlU4cEdqaG9SYldyTERsYW1BZnFfeTRTMUNaRzFWdW9lUkxBUnJFIiwib3JpZ2luIjoiaHR0cHM6Ly93ZWJhdXRobi5pbyIsInR5cGUiOiJ3ZWJhdXRobi5jcmVhdGUifQ"
+	realAttestationObject      = "o2NmbXRkbm9uZWdhdHRTdG10oGhhdXRoRGF0YVjEdKbqkhPJnC90siSSsyDPQCYqlMGpUKA5fyklC2CEHvBBAAAAAAAAAAAAAAAAAAAAAAAAAAAAQOsa7QYSUFukFOLTmgeK6x2ktirNMgwy_6vIwwtegxI2flS1X-JAkZL5dsadg-9bEz2J7PnsbB0B08txvsyUSvKlAQIDJiABIVggLKF5xS0_BntttUIrm2Z2tgZ4uQDwllbdIfrrBMABCNciWCDHwin8Zdkr56iSIh0MrB5qZiEzYLQpEOREhMUkY6q4Vw"
+
+	// macOS Touch ID, ES256, user verified. The authenticator data also
+	// carries the credential, which is where its public key is taken from.
+	realLoginChallenge  = "E4PTcIH_HfX1pC6Sigk1SC9NAlgeztN0439vi8z_c9k"
+	realLoginClientData = "eyJjaGFsbGVuZ2UiOiJFNFBUY0lIX0hmWDFwQzZTaWdrMVNDOU5BbGdlenROMDQzOXZpOHpfYzlrIiwibmV3X2tleXNfbWF5X2JlX2FkZGVkX2hlcmUiOiJkbyBub3QgY29tcGFyZSBjbGllbnREYXRhSlNPTiBhZ2FpbnN0IGEgdGVtcGxhdGUuIFNlZSBodHRwczovL2dvby5nbC95YWJQZXgiLCJvcmlnaW4iOiJodHRwczovL3dlYmF1dGhuLmlvIiwidHlwZSI6IndlYmF1dGhuLmdldCJ9"
+	realLoginAuthData   = "dKbqkhPJnC90siSSsyDPQCYqlMGpUKA5fyklC2CEHvBFXJJiGa3OAAI1vMYKZIsLJfHwVQMANwCOw-atj9C0vhWpfWU-whzNjeQS21Lpxfdk_G-omAtffWztpGoErlNOfuXWRqm9Uj9ANJck1p6lAQIDJiABIVggKAhfsdHcBIc0KPgAcRyAIK_-Vi-nCXHkRHPNaCMBZ-4iWCBxB8fGYQSBONi9uvq0gv95dGWlhJrBwCsj_a4LJQKVHQ"
+	realLoginSignature  = "MEUCIBtIVOQxzFYdyWQyxaLR0tik1TnuPhGVhXVSNgFwLmN5AiEAnxXdCq0UeAVGWxOaFcjBZ_mEZoXqNboY5IkQDdlWZYc"
+	realLoginSignCount  = 1553097241
+)
+
+var realRP = RelyingParty{ID: "webauthn.io", Name: "WebAuthn.io", Origins: []string{"https://webauthn.io"}}
+
+var testRP = RelyingParty{
+	ID:      "example.com",
+	Name:    "Sudoku",
+	Origins: []string{"https://www.example.com", "https://example.com"},
+}
+
+func decodeB64(t testing.TB, s string) []byte {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRealLogin(t *testing.T) {
+	authData := decodeB64(t, realLoginAuthData)
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := Credential{Id: ad.credentialId, PublicKey: ad.publicKey, SignCount: 1000}
+	signCount, err := realRP.VerifyLogin(
+		decodeB64(t, realLoginChallenge), credential,
+		decodeB64(t, realLoginClientData), authData, decodeB64(t, realLoginSignature),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signCount != realLoginSignCount {
+		t.Errorf("got sign count %v, want %v", signCount, realLoginSignCount)
+	}
+}
+
+func TestRealRegistrationWithoutUserVerification(t *testing.T) {
+	_, err := realRP.VerifyRegistration(
+		decodeB64(t, realRegistrationChallenge),
+		decodeB64(t, realRegistrationClientData),
+		decodeB64(t, realAttestationObject),
+	)
+	if !errors.Is(err, ErrInvalid) {
+		t.Errorf("got error %v, want %v", err, ErrInvalid)
+	}
+}
+
+// cborPair keeps map entries in order, so that encoded maps are deterministic.
+type cborPair struct {
+	key, value any
+}
+
+func encodeCBORHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+	}
+}
+
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return encodeCBORHead(1, uint64(-1-v))
+		}
+		return encodeCBORHead(0, uint64(v))
+	case []byte:
+		return append(encodeCBORHead(2, uint64(len(v))), v...)
+	case string:
+		return append(encodeCBORHead(3, uint64(len(v))), v...)
+	case []cborPair:
+		out := encodeCBORHead(5, uint64(len(v)))
+		for _, p := range v {
+			out = append(out, encodeCBOR(p.key)...)
+			out = append(out, encodeCBOR(p.value)...)
+		}
+		return out
+	default:
+		panic("unsupported CBOR value")
+	}
+}
+
+// authenticator is a software ES256 passkey.
+type authenticator struct {
+	t            testing.TB
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	signCount    uint32
+
+	// Overrides of what a well behaved authenticator and browser send.
+	rpId   string
+	origin string
+	flags  byte
+}
+
+func newAuthenticator(t testing.TB) *authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	rand.Read(credentialId)
+	return &authenticator{
+		t:            t,
+		key:          key,
+		credentialId: credentialId,
+		rpId:         testRP.ID,
+		origin:       testRP.Origins[0],
+		flags:        flagUserPresent | flagUserVerified,
+	}
+}
+
+func (a *authenticator) clientData(typ string, challenge []byte) []byte {
+	data, err := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+func (a *authenticator) authData(flags byte, attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *authenticator) coseKey() []byte {
+	return encodeCBOR([]cborPair{
+		{1, 2},        // kty: EC2
+		{3, AlgES256}, // alg
+		{-1, 1},       // crv: P-256
+		{-2, a.key.X.FillBytes(make([]byte, 32))},
+		{-3, a.key.Y.FillBytes(make([]byte, 32))},
+	})
+}
+
+// register returns clientDataJSON and attestationObject of a registration.
+func (a *authenticator) register(challenge []byte) ([]byte, []byte) {
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(attested, a.credentialId...)
+	attested = append(attested, a.coseKey()...)
+
+	attestationObject := encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(a.flags|flagAttestedData, attested)},
+	})
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+// login returns clientDataJSON, authenticatorData and signature of a login.
+func (a *authenticator) login(challenge []byte) ([]byte, []byte, []byte) {
+	a.signCount++
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authData(a.flags, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(slices.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return clientData, authData, signature
+}
+
+func challenge(t testing.TB) []byte {
+	c, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	a := newAuthenticator(t)
+	regChallenge := challenge(t)
+	clientData, attestationObject := a.register(regChallenge)
+	credential, err := testRP.VerifyRegistration(regChallenge, clientData, attestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(credential.Id, a.credentialId) || !bytes.Equal(credential.PublicKey, a.coseKey()) {
+		t.Fatalf("unexpected credential %+v", credential)
+	}
+
+	for want := uint32(1); want <= 2; want++ {
+		loginChallenge := challenge(t)
+		clientData, authData, signature := a.login(loginChallenge)
+		signCount, err := testRP.VerifyLogin(loginChallenge, credential, clientData, authData, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signCount != want {
+			t.Errorf("got sign count %v, want %v", signCount, want)
+		}
+		credential.SignCount = signCount
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *authenticator)
+	}{
+		{"wrong origin", func(a *authenticator) { a.origin = "https://evil.example.net" }},
+		{"wrong rpIdHash", func(a *authenticator) { a.rpId = "evil.example.net" }},
+		{"user verification missing", func(a *authenticator) { a.flags = flagUserPresent }},
+		{"user presence missing", func(a *authenticator) { a.flags = flagUserVerified }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := newAuthenticator(t)
+			test.modify(a)
+			c := challenge(t)
+			clientData, attestationObject := a.register(c)
+			_, err := testRP.VerifyRegistration(c, clientData, attestationObject)
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("got error %v, want %v", err, ErrInvalid)
+			}
+		})
+	}
+
+	t.Run("wrong challenge", func(t *testing.T) {
+		a := newAuthenticator(t)
+		clientData, attestationObject := a.register(challenge(t))
+		_, err := testRP.VerifyRegistration(challenge(t), clientData, attestationObject)
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("got error %v, want %v", err, ErrInvalid)
+		}
+	})
+}
+
+// registered returns an authenticator and the credential it registered.
+func registered(t *testing.T) (*authenticator, Credential) {
+	a := newAuthenticator(t)
+	c := challenge(t)
+	clientData, attestationObject := a.register(c)
+	credential, err := testRP.VerifyRegistration(c, clientData, attestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, credential
+}
+
+func TestLoginRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(a *authenticator)
+	}{
+		{"wrong origin", func(a *authenticator) { a.origin = "https://evil.example.net" }},
+		{"wrong rpIdHash", func(a *authenticator) { a.rpId = "evil.example.net" }},
+		{"user verification missing", func(a *authenticator) { a.flags = flagUserPresent }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, credential := registered(t)
+			test.modify(a)
+			c := challenge(t)
+			clientData, authData, signature := a.login(c)
+			_, err := testRP.VerifyLogin(c, credential, clientData, authData, signature)
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("got error %v, want %v", err, ErrInvalid)
+			}
+		})
+	}
+
+	t.Run("signature of another key", func(t *testing.T) {
+		_, credential := registered(t)
+		other := newAuthenticator(t)
+		c := challenge(t)
+		clientData, authData, signature := other.login(c)
+		_, err := testRP.VerifyLogin(c, credential, clientData, authData, signature)
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("got error %v, want %v", err, ErrInvalid)
+		}
+	})
+
+	t.Run("registration response", func(t *testing.T) {
+		a, credential := registered(t)
+		c := challenge(t)
+		clientData, _ := a.register(c)
+		_, authData, signature := a.login(c)
+		_, err := testRP.VerifyLogin(c, credential, clientData, authData, signature)
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("got error %v, want %v", err, ErrInvalid)
+		}
+	})
+}
+
+func TestLoginSignCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    uint32
+		sent      uint32
+		wantError error
+	}{
+		{"increased", 5, 6, nil},
+		{"went backwards", 5, 4, ErrSignCount},
+		{"unchanged", 5, 5, ErrSignCount},
+		{"reset to zero", 5, 0, ErrSignCount},
+		{"not counting", 0, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, credential := registered(t)
+			credential.SignCount = test.stored
+			a.signCount = test.sent - 1 // login increments it first
+			c := challenge(t)
+			clientData, authData, signature := a.login(c)
+			_, err := testRP.VerifyLogin(c, credential, clientData, authData, signature)
+			if !errors.Is(err, test.wantError) {
+				t.Errorf("got error %v, want %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// examples from RFC 8949, appendix A
+	tests := []struct {
+		hex  string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, rest, err := decodeCBOR(data)
+		if err != nil || len(rest) != 0 {
+			t.Errorf("%v: got error %v and %v bytes left", test.hex, err, len(rest))
+			continue
+		}
+		gotBytes, isBytes := got.([]byte)
+		wantBytes, wantsBytes := test.want.([]byte)
+		if isBytes && wantsBytes {
+			if !bytes.Equal(gotBytes, wantBytes) {
+				t.Errorf("%v: got %v, want %v", test.hex, got, test.want)
+			}
+		} else if got != test.want {
+			t.Errorf("%v: got %#v, want %#v", test.hex, got, test.want)
+		}
+	}
+
+	for _, data := range [][]byte{
+		{},
+		{0x1c},             // reserved additional info
+		{0x5f},             // indefinite length byte string
+		{0xc0, 0x00},       // tag
+		{0xf9, 0x3c, 0x00}, // float
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // huge array
+		{0xa1, 0x40, 0x00}, // byte string key
+		bytes.Repeat([]byte{0x81}, cborMaxDepth+2),
+	} {
+		if _, _, err := decodeCBOR(data); !errors.Is(err, errCBOR) {
+			t.Errorf("%x: got error %v, want %v", data, err, errCBOR)
+		}
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add(decodeB64(f, realAttestationObject))
+	// the COSE key after the header, AAGUID, length and id of the credential
+	f.Add(decodeB64(f, realLoginAuthData)[37+18+55:])
+	f.Add(newAuthenticator(f).coseKey())
+	f.Add([]byte{0x82, 0x01, 0xa1, 0x61, 0x61, 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, rest, err := decodeCBOR(data)
+		if err != nil {
+			return
+		}
+		if len(rest) >= len(data) || !bytes.HasSuffix(data, rest) {
+			t.Fatalf("decoded %v, but %v of %v bytes are left", v, len(rest), len(data))
+		}
+		// parsers built on top must not panic either
+		parsePublicKey(data)
+		parseAuthenticatorData(data)
+	})
+}
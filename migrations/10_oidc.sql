@@ -0,0 +1,30 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.user_identities
+    (
+        provider text NOT NULL,
+        subject text NOT NULL,
+        user_id integer NOT NULL,
+        email text NOT NULL,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        CONSTRAINT user_identities_pkey PRIMARY KEY (provider, subject),
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+    CREATE INDEX IF NOT EXISTS user_identities_user_id
+        ON user_identities USING btree (user_id);
+
+    CREATE TABLE IF NOT EXISTS public.oidc_login_states
+    (
+        state text PRIMARY KEY,
+        provider text NOT NULL,
+        nonce text NOT NULL,
+        code_verifier text NOT NULL,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        expires_at timestamp with time zone NOT NULL
+    );
+
+COMMIT;
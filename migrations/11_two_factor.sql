@@ -0,0 +1,35 @@
+BEGIN;
+
+    -- The secret is set when enrolment starts, totp_enabled once the first
+    -- code is verified.
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret bytea;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+
+    CREATE TABLE IF NOT EXISTS public.recovery_codes
+    (
+        user_id integer NOT NULL,
+        code_hash bytea NOT NULL,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        used_at timestamp with time zone,
+        CONSTRAINT recovery_codes_pkey PRIMARY KEY (user_id, code_hash),
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+    CREATE TABLE IF NOT EXISTS public.login_challenges
+    (
+        token_hash bytea PRIMARY KEY,
+        user_id integer NOT NULL,
+        attempts integer NOT NULL DEFAULT 0,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        expires_at timestamp with time zone NOT NULL,
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+COMMIT;
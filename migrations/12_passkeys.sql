@@ -0,0 +1,35 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.passkeys
+    (
+        id bytea PRIMARY KEY,
+        user_id integer NOT NULL,
+        name text NOT NULL,
+        public_key bytea NOT NULL,
+        sign_count bigint NOT NULL DEFAULT 0,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        last_used_at timestamp with time zone,
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+    CREATE INDEX IF NOT EXISTS passkeys_user_id
+        ON passkeys USING btree (user_id);
+
+    -- user_id is set for registrations and NULL for logins, where the user is
+    -- not known until the passkey is used.
+    CREATE TABLE IF NOT EXISTS public.webauthn_challenges
+    (
+        challenge bytea PRIMARY KEY,
+        user_id integer,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        expires_at timestamp with time zone NOT NULL,
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+COMMIT;
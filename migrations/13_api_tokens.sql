@@ -0,0 +1,23 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.api_tokens
+    (
+        id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+        user_id integer NOT NULL,
+        name text NOT NULL,
+        token_hash bytea NOT NULL,
+        scopes text[] NOT NULL,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        expires_at timestamp with time zone,
+        last_used_at timestamp with time zone,
+        CONSTRAINT unique_api_token_hash UNIQUE (token_hash),
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+    CREATE INDEX IF NOT EXISTS api_tokens_user_id
+        ON api_tokens USING btree (user_id);
+
+COMMIT;
@@ -0,0 +1,38 @@
+BEGIN;
+
+    -- Emails that differ only in case belong to the same mailbox but could be
+    -- registered as separate accounts. Such accounts have to be merged or
+    -- deleted by hand, the migration lists them and fails until then.
+    DO $$
+    DECLARE
+        duplicates text;
+    BEGIN
+        SELECT string_agg(format('%s (user ids: %s)', email, ids), '; ')
+        INTO duplicates
+        FROM (
+            SELECT lower(email) AS email, string_agg(id::text, ', ' ORDER BY id) AS ids
+            FROM users
+            GROUP BY lower(email)
+            HAVING count(*) > 1
+        ) d;
+
+        IF duplicates IS NOT NULL THEN
+            RAISE EXCEPTION 'Duplicate emails differing only in case: %', duplicates;
+        END IF;
+    END $$;
+
+    -- New emails are stored with a lowercase domain.
+    UPDATE users
+    SET email = split_part(email, '@', 1) || '@' || lower(split_part(email, '@', 2))
+    WHERE email LIKE '%@%' AND split_part(email, '@', 2) <> lower(split_part(email, '@', 2));
+
+    CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower
+        ON users USING btree (lower(email));
+
+    -- 0_initial.sql creates a case-sensitive unique constraint and index that
+    -- the one above replaces. The index is created again whenever the
+    -- migrations run, so it's dropped again here.
+    ALTER TABLE users DROP CONSTRAINT IF EXISTS unique_email;
+    DROP INDEX IF EXISTS users_email;
+
+COMMIT;
@@ -0,0 +1,16 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.login_tokens
+    (
+        user_id integer NOT NULL,
+        token uuid NOT NULL DEFAULT gen_random_uuid(),
+        created_at timestamp with time zone DEFAULT now(),
+        expires_at timestamp with time zone,
+        CONSTRAINT login_tokens_pkey PRIMARY KEY (user_id),
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+COMMIT;
@@ -0,0 +1,24 @@
+BEGIN;
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user'
+        CONSTRAINT roles CHECK (role IN ('user', 'admin'));
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT False;
+
+    -- Users are kept out of the foreign keys on purpose, entries have to
+    -- outlive the accounts they mention.
+    CREATE TABLE IF NOT EXISTS public.audit_log
+    (
+        id bigint PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+        -- NULL for actions done from the command line
+        actor_id integer,
+        actor_email text,
+        action text NOT NULL,
+        target_user_id integer,
+        details jsonb NOT NULL DEFAULT '{}',
+        created_at timestamp with time zone NOT NULL DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS audit_log_target_user_id
+        ON audit_log USING btree (target_user_id);
+
+COMMIT;
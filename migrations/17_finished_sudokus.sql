@@ -0,0 +1,5 @@
+BEGIN;
+
+    ALTER TABLE played_sudokus ADD COLUMN IF NOT EXISTS finished_at timestamp with time zone;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+    -- Hash of the secret in the login_link cookie of the browser that asked
+    -- for the link. Links sent before it was added can't be used anymore.
+    ALTER TABLE login_tokens ADD COLUMN IF NOT EXISTS browser_hash bytea;
+
+COMMIT;
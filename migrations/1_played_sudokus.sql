@@ -0,0 +1,15 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.played_sudokus
+    (
+        user_id integer NOT NULL,
+        sudoku text NOT NULL,
+        served_at timestamp with time zone NOT NULL DEFAULT now(),
+        CONSTRAINT played_sudokus_pkey PRIMARY KEY (user_id, sudoku),
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+COMMIT;
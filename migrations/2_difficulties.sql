@@ -0,0 +1,21 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.difficulties
+    (
+        name text PRIMARY KEY,
+        min_hints integer NOT NULL,
+        max_hints integer NOT NULL,
+        display_order integer NOT NULL DEFAULT 0,
+        CONSTRAINT hints_range CHECK (0 < min_hints AND min_hints <= max_hints)
+    );
+
+    -- seed only an empty table so that removed tiers do not come back
+    INSERT INTO difficulties (name, min_hints, max_hints, display_order)
+        SELECT * FROM (VALUES
+            ('easy', 40, 40, 1),
+            ('medium', 32, 32, 2),
+            ('hard', 25, 25, 3)
+        ) AS defaults
+        WHERE NOT EXISTS (SELECT 1 FROM difficulties);
+
+COMMIT;
@@ -0,0 +1,29 @@
+BEGIN;
+
+    DO $$
+    BEGIN
+        IF NOT EXISTS (
+            SELECT 1 FROM information_schema.columns
+            WHERE table_name = 'difficulties' AND column_name = 'size'
+        ) THEN
+            ALTER TABLE difficulties
+                ADD COLUMN size integer NOT NULL DEFAULT 9,
+                ADD CONSTRAINT sizes CHECK (size IN (4, 9, 16));
+
+            -- the same tier names are used for every size
+            ALTER TABLE difficulties DROP CONSTRAINT difficulties_pkey;
+            ALTER TABLE difficulties ADD CONSTRAINT difficulties_pkey PRIMARY KEY (name, size);
+
+            INSERT INTO difficulties (name, size, min_hints, max_hints, display_order) VALUES
+                ('easy', 4, 8, 9, 1),
+                ('medium', 4, 6, 7, 2),
+                ('hard', 4, 4, 5, 3),
+                ('easy', 16, 160, 170, 1),
+                ('medium', 16, 145, 155, 2),
+                ('hard', 16, 130, 140, 3)
+            ON CONFLICT DO NOTHING;
+        END IF;
+    END
+    $$;
+
+COMMIT;
@@ -0,0 +1,22 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.sessions
+    (
+        id uuid NOT NULL DEFAULT gen_random_uuid(),
+        user_id integer NOT NULL,
+        token_hash bytea NOT NULL,
+        created_at timestamp with time zone NOT NULL DEFAULT now(),
+        expires_at timestamp with time zone NOT NULL,
+        CONSTRAINT sessions_pkey PRIMARY KEY (id),
+        CONSTRAINT unique_token_hash UNIQUE (token_hash),
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+    CREATE INDEX IF NOT EXISTS sessions_user_id
+        ON sessions USING btree
+        (user_id ASC NULLS LAST);
+
+COMMIT;
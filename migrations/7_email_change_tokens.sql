@@ -0,0 +1,17 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.email_change_tokens
+    (
+        user_id integer NOT NULL,
+        new_email text NOT NULL,
+        token uuid NOT NULL DEFAULT gen_random_uuid(),
+        created_at timestamp with time zone DEFAULT now(),
+        expires_at timestamp with time zone,
+        CONSTRAINT email_change_tokens_pkey PRIMARY KEY (user_id),
+        CONSTRAINT user_id FOREIGN KEY (user_id)
+            REFERENCES public.users (id) MATCH SIMPLE
+            ON UPDATE NO ACTION
+            ON DELETE CASCADE
+    );
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+    CREATE TABLE IF NOT EXISTS public.rate_limit_buckets
+    (
+        key text NOT NULL,
+        tokens double precision NOT NULL,
+        updated_at timestamp with time zone NOT NULL DEFAULT now(),
+        CONSTRAINT rate_limit_buckets_pkey PRIMARY KEY (key)
+    );
+
+COMMIT;
@@ -1,38 +1,302 @@
 import { validateEmail, validatePassword } from "./validations.js"
 
-async function loginOrRegister(endpoint: string, email: string, password: string): Promise<string[]> {
-    let errors: string[] = []
-    errors.push(...validateEmail(email))
-    errors.push(...validatePassword(password))
-    if (errors.length > 0) {
-        return errors
+const failedToReachServer = "Failed to reach server. Try again."
+const tooManyRequests = "Too many attempts. Try again later."
+
+type PasswordPolicyError = {
+    code: string
+    message?: string
+    minLength?: number
+    maxLength?: number
+}
+
+// The limits come with the error, without them the server's message is used.
+const passwordErrorMessages: Record<string, (error: PasswordPolicyError) => string | null> = {
+    password_too_short: (e) =>
+        e.minLength == undefined ? null : `Password has to be at least ${e.minLength} characters long.`,
+    password_too_long: (e) =>
+        e.maxLength == undefined ? null : `Password can be no longer than ${e.maxLength} characters.`,
+    password_common: () => "This password is too common. Choose a different one.",
+    password_breached: () => "This password appeared in a data breach. Choose a different one.",
+}
+
+// Returns a message for a rejected password or null if the response is not
+// a password policy error.
+async function passwordError(response: Response): Promise<string | null> {
+    if (response.status != 400 || response.headers.get("Content-Type") != "application/json") {
+        return null
+    }
+    try {
+        const error: PasswordPolicyError = await response.json()
+        return passwordErrorMessages[error.code]?.(error) ?? error.message ?? null
+    } catch {
+        return null
+    }
+}
+
+function csrfToken(): string {
+    const meta = document.querySelector('meta[name="csrf-token"]')
+    return meta?.getAttribute("content") ?? ""
+}
+
+// The server explains why a login was refused, e.g. that the email is not
+// verified or that the account is disabled.
+async function forbiddenError(response: Response): Promise<string> {
+    try {
+        return (await response.text()).trim() || "Access denied."
+    } catch {
+        return "Access denied."
     }
+}
+
+async function post(endpoint: string, body: object): Promise<Response | null> {
     const request = new Request(
         endpoint,
         {
             method: "POST",
-            body: JSON.stringify({ email: email, password: password }),
+            headers: { "X-CSRF-Token": csrfToken() },
+            body: JSON.stringify(body),
         }
     )
-    let response = null
     try {
-        response = await fetch(request, { signal: AbortSignal.timeout(5000) })
+        return await fetch(request, { signal: AbortSignal.timeout(5000) })
     } catch (e) {
-        return ["Failed to reach server. Try again."]
+        return null
     }
-    if (response.ok) {
+}
+
+// Records a finished sudoku so that the server doesn't serve it again. Only
+// works for logged in users, for others the request is rejected and ignored.
+export async function finishSudoku(sudoku: string): Promise<void> {
+    await post("/api/sudokus/finished", { sudoku: sudoku })
+}
+
+// Set by login when a second factor is needed, see loginTwoFactor.
+export let loginChallenge: string | null = null
+
+async function loginOrRegister(endpoint: string, email: string, password: string): Promise<string[]> {
+    let errors: string[] = []
+    errors.push(...validateEmail(email))
+    errors.push(...validatePassword(password))
+    if (errors.length > 0) {
+        return errors
+    }
+    const response = await post(endpoint, { email: email, password: password })
+    if (response == null) {
+        return [failedToReachServer]
+    }
+    const passwordErrorMessage = await passwordError(response)
+    if (passwordErrorMessage != null) {
+        return [passwordErrorMessage]
+    }
+    if (response.status == 202) {
+        loginChallenge = (await response.json()).challenge
+        return []
+    } else if (response.ok) {
         return []
     } else if (response.status == 401) {
         return ["Invalid email and password combination."]
+    } else if (response.status == 403) {
+        return [await forbiddenError(response)]
+    } else if (response.status == 429) {
+        return [tooManyRequests]
     } else {
         return ["Unexpected error."]
     }
 }
 
 export async function login(email: string, password: string): Promise<string[]> {
+    loginChallenge = null
     return loginOrRegister("/api/login", email, password)
 }
 
 export async function register(email: string, password: string): Promise<string[]> {
     return loginOrRegister("/api/register", email, password)
 }
+
+async function sendEmailLink(endpoint: string, email: string): Promise<string[]> {
+    const errors = validateEmail(email)
+    if (errors.length > 0) {
+        return errors
+    }
+    const response = await post(endpoint, { email: email })
+    if (response == null) {
+        return [failedToReachServer]
+    }
+    if (response.ok) {
+        return []
+    } else if (response.status == 429) {
+        return [tooManyRequests]
+    } else {
+        return ["Unexpected error."]
+    }
+}
+
+export async function forgotPassword(email: string): Promise<string[]> {
+    return sendEmailLink("/api/password/forgot", email)
+}
+
+export async function resendVerification(email: string): Promise<string[]> {
+    return sendEmailLink("/api/verification/resend", email)
+}
+
+export async function magicLogin(email: string): Promise<string[]> {
+    return sendEmailLink("/api/login/magic", email)
+}
+
+// Logs in with the token of a link sent by magicLogin. Like login it sets
+// loginChallenge when a second factor is needed.
+export async function loginWithLink(token: string): Promise<string[]> {
+    loginChallenge = null
+    const response = await post("/api/login/link", { token: token })
+    if (response == null) {
+        return [failedToReachServer]
+    }
+    if (response.status == 202) {
+        loginChallenge = (await response.json()).challenge
+        return []
+    } else if (response.ok) {
+        return []
+    } else if (response.status == 400 || response.status == 403) {
+        return [(await response.text()).trim()]
+    } else if (response.status == 429) {
+        return [tooManyRequests]
+    } else {
+        return ["Unexpected error."]
+    }
+}
+
+export async function loginTwoFactor(challenge: string, code: string): Promise<string[]> {
+    if (code.trim() == "") {
+        return ["Enter a code."]
+    }
+    const response = await post("/api/login/two-factor", { challenge: challenge, code: code })
+    if (response == null) {
+        return [failedToReachServer]
+    }
+    if (response.ok) {
+        return []
+    } else if (response.status == 401) {
+        return [(await response.text()).trim()]
+    } else if (response.status == 403) {
+        return [await forbiddenError(response)]
+    } else if (response.status == 429) {
+        return [tooManyRequests]
+    } else {
+        return ["Unexpected error."]
+    }
+}
+
+function fromBase64URL(value: string): ArrayBuffer {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/")
+    const binary = atob(base64)
+    const bytes = new Uint8Array(binary.length)
+    for (let i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i)
+    }
+    return bytes.buffer
+}
+
+function toBase64URL(buffer: ArrayBuffer): string {
+    let binary = ""
+    for (const byte of new Uint8Array(buffer)) {
+        binary += String.fromCharCode(byte)
+    }
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "")
+}
+
+export function passkeysSupported(): boolean {
+    return window.PublicKeyCredential !== undefined
+}
+
+export async function loginWithPasskey(): Promise<string[]> {
+    const optionsResponse = await post("/api/login/passkey/begin", {})
+    if (optionsResponse == null) {
+        return [failedToReachServer]
+    }
+    if (optionsResponse.status == 429) {
+        return [tooManyRequests]
+    }
+    if (!optionsResponse.ok) {
+        return ["Unexpected error."]
+    }
+    const options = await optionsResponse.json()
+
+    let credential: PublicKeyCredential
+    try {
+        credential = await navigator.credentials.get({
+            publicKey: {
+                challenge: fromBase64URL(options.challenge),
+                rpId: options.rpId,
+                timeout: options.timeout,
+                userVerification: options.userVerification,
+            },
+        }) as PublicKeyCredential
+    } catch (e) {
+        return ["Passkey login cancelled."]
+    }
+    const assertion = credential.response as AuthenticatorAssertionResponse
+
+    const response = await post("/api/login/passkey/finish", {
+        credentialId: toBase64URL(credential.rawId),
+        clientDataJSON: toBase64URL(assertion.clientDataJSON),
+        authenticatorData: toBase64URL(assertion.authenticatorData),
+        signature: toBase64URL(assertion.signature),
+        userHandle: assertion.userHandle ? toBase64URL(assertion.userHandle) : null,
+    })
+    if (response == null) {
+        return [failedToReachServer]
+    }
+    if (response.ok) {
+        return []
+    } else if (response.status == 401 || response.status == 400) {
+        return ["Passkey not recognized."]
+    } else if (response.status == 403) {
+        return [await forbiddenError(response)]
+    } else if (response.status == 429) {
+        return [tooManyRequests]
+    } else {
+        return ["Unexpected error."]
+    }
+}
+
+export async function resetPassword(token: string, password: string): Promise<string[]> {
+    const errors = validatePassword(password)
+    if (errors.length > 0) {
+        return errors
+    }
+    const response = await post("/api/password/reset", { token: token, password: password })
+    if (response == null) {
+        return [failedToReachServer]
+    }
+    const passwordErrorMessage = await passwordError(response)
+    if (passwordErrorMessage != null) {
+        return [passwordErrorMessage]
+    }
+    if (response.ok) {
+        return []
+    } else if (response.status == 400) {
+        return ["Invalid or expired reset link. Request a new one."]
+    } else if (response.status == 429) {
+        return [tooManyRequests]
+    } else {
+        return ["Unexpected error."]
+    }
+}
+
+export type OIDCProvider = {
+    name: string
+    displayName: string
+}
+
+export async function oidcProviders(): Promise<OIDCProvider[]> {
+    try {
+        const response = await fetch("/api/oidc/providers")
+        if (!response.ok) {
+            return []
+        }
+        return await response.json()
+    } catch {
+        return []
+    }
+}
@@ -0,0 +1,21 @@
+import { themeSetting } from "./settings.js"
+import * as docUtils from "./docUtils.js"
+import * as auth from "./auth.js"
+
+const forgotPasswordForm = docUtils.getForm("forgot-password-form")
+const emailInput = docUtils.getInput("email-input")
+const errorMsgsDiv = docUtils.getDiv("forgot-password-form-errors")
+
+async function onForgotPasswordSubmit(event: Event) {
+    event.preventDefault()
+    errorMsgsDiv.innerText = ""
+    const errors = await auth.forgotPassword(emailInput.value)
+    if (errors.length == 0) {
+        window.location.href = "/password-reset-requested"
+    } else {
+        errorMsgsDiv.innerText = errors.join("\n")
+    }
+}
+
+forgotPasswordForm.addEventListener("submit", onForgotPasswordSubmit)
+themeSetting.runOnSet()
@@ -22,6 +22,7 @@ import {
     getButton,
     getDialog,
 } from "./docUtils.js"
+import { finishSudoku } from "./auth.js"
 
 // SETTINGS DIALOG
 
@@ -370,6 +371,9 @@ SudokuSolvedEvent.listen((_: SudokuSolvedEvent) => {
     const text = `Sudoku solved in ${time}!`
     endGameText.innerText = text
     endGameDialog.showModal()
+    if (richSudoku.source != "") {
+        finishSudoku(richSudoku.source)
+    }
 })
 
 SudokuGameLoadEvent.listen((_: SudokuGameLoadEvent) => {
@@ -414,17 +418,53 @@ function sudokuFromStrList(s: string): number[][] {
     return result
 }
 
-async function newGame(difficulty: Difficulty = "medium"): Promise<void> {
-    const params = new URLSearchParams({
-        "difficulty": difficulty,
-    })
+type DifficultyInfo = { name: Difficulty }
+
+// Tiers defined on the server, in display order.
+async function fetchDifficulties(): Promise<DifficultyInfo[]> {
+    try {
+        const response = await fetch("/api/difficulties")
+        if (!response.ok) {
+            return []
+        }
+        return await response.json()
+    } catch {
+        return []
+    }
+}
+
+const difficulties = await fetchDifficulties()
+
+function showGameError(message: string): void {
+    endGameText.innerText = message
+    endGameDialog.showModal()
+}
+
+// Without a difficulty the first tier listed by the server is used, or if
+// there are none, the server picks one.
+async function newGame(difficulty?: Difficulty): Promise<void> {
+    const params = new URLSearchParams()
+    const chosen = difficulty ?? difficulties[0]?.name
+    if (chosen !== undefined) {
+        params.set("difficulty", chosen)
+    }
     const req = `/api/random-sudoku?${params.toString()}`
-    const response = await fetch(req)
+    let response: Response
+    try {
+        response = await fetch(req)
+    } catch {
+        showGameError("Failed to reach the server. Try again later.")
+        return
+    }
     const text = await response.text()
+    if (!response.ok) {
+        showGameError(text.trim() || "Failed to load a sudoku. Try again later.")
+        return
+    }
     const lines = text.split("\n")
     let sudoku = new Sudoku(3, sudokuFromStrList(lines[1]))
     shuffleSudoku(sudoku)
-    richSudoku.newGame(sudoku, true, difficulty, false)
+    richSudoku.newGame(sudoku, true, lines[0], false, lines[1])
 }
 
 if (!richSudoku.load()) {
@@ -451,9 +491,7 @@ button.onclick = toggleInputMode
 let newGameButton = getButton("new-game-button")
 let newGameDialog = getDialog("new-game-dialog")
 let newGameDialogCloseButton = getDiv("new-game-dialog-close-button")
-let newGameEasy = getDiv("new-game-easy-button")
-let newGameMedium = getDiv("new-game-medium-button")
-let newGameHard = getDiv("new-game-hard-button")
+let newGameDifficulties = getDiv("new-game-difficulties")
 
 newGameButton.onclick = () => {
     richSudoku.timer.pause()
@@ -468,18 +506,21 @@ newGameDialog.onclose = () => {
     resumeTimer()
 }
 
-const newGameButtons: [HTMLDivElement, Difficulty][] = [
-    [newGameEasy, "easy"],
-    [newGameMedium, "medium"],
-    [newGameHard, "hard"]
-]
-for (const [btn, diff] of newGameButtons) {
-    btn.onclick = async () => {
-        newGameDialog.close()
-        await newGame(diff)
+function loadDifficulties(): void {
+    for (const diff of difficulties) {
+        let btn = document.createElement("div")
+        btn.classList.add("dialog-button")
+        btn.innerText = diff.name
+        btn.onclick = async () => {
+            newGameDialog.close()
+            await newGame(diff.name)
+        }
+        newGameDifficulties.appendChild(btn)
     }
 }
 
+loadDifficulties()
+
 let pauseButton = getDiv("pause-button")
 let resumeButton = getDiv("resume-button")
 let pauseDialog = getDialog("pause-dialog")
@@ -542,7 +583,7 @@ setInterval(function() { richSudoku.save() }, 1000)
 
 // DIFFICULTY
 
-type Difficulty = "easy" | "medium" | "hard"
+type Difficulty = string
 
 function getDifficultyDiv(): HTMLDivElement {
     return getDiv("game-difficulty")
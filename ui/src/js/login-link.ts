@@ -0,0 +1,23 @@
+import { themeSetting } from "./settings.js"
+import * as docUtils from "./docUtils.js"
+import * as auth from "./auth.js"
+
+const loginLinkForm = docUtils.getForm("login-link-form")
+const errorMsgsDiv = docUtils.getDiv("login-link-form-errors")
+
+async function onLoginLinkSubmit(event: Event): Promise<void> {
+    event.preventDefault()
+    errorMsgsDiv.innerText = ""
+    const token = window.location.pathname.split("/").pop() ?? ""
+    const errors = await auth.loginWithLink(token)
+    if (errors.length == 0 && auth.loginChallenge != null) {
+        window.location.href = "/two-factor#" + auth.loginChallenge
+    } else if (errors.length == 0) {
+        window.location.href = "/"
+    } else {
+        errorMsgsDiv.innerText = errors.join("\n")
+    }
+}
+
+loginLinkForm.addEventListener("submit", onLoginLinkSubmit)
+themeSetting.runOnSet()
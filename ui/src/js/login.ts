@@ -6,11 +6,26 @@ const loginForm = docUtils.getForm("login-form")
 const emailInput = docUtils.getInput("email-input")
 const passwordInput = docUtils.getInput("pass-input")
 const errorMsgsDiv = docUtils.getDiv("login-form-errors")
+const oidcProvidersDiv = docUtils.getDiv("oidc-providers")
+const passkeyLoginLink = docUtils.getHtmlElement("passkey-login", HTMLAnchorElement, "a")
 
 async function onLoginSubmit(event: Event): Promise<void> {
     event.preventDefault()
     errorMsgsDiv.innerText = ""
     const errors = await auth.login(emailInput.value, passwordInput.value)
+    if (errors.length == 0 && auth.loginChallenge != null) {
+        window.location.href = "/two-factor#" + auth.loginChallenge
+    } else if (errors.length == 0) {
+        window.location.href = "/"
+    } else {
+        errorMsgsDiv.innerText = errors.join("\n")
+    }
+}
+
+async function onPasskeyLoginClick(event: Event): Promise<void> {
+    event.preventDefault()
+    errorMsgsDiv.innerText = ""
+    const errors = await auth.loginWithPasskey()
     if (errors.length == 0) {
         window.location.href = "/"
     } else {
@@ -18,5 +33,21 @@ async function onLoginSubmit(event: Event): Promise<void> {
     }
 }
 
+async function loadOIDCProviders(): Promise<void> {
+    const providers = await auth.oidcProviders()
+    for (const provider of providers) {
+        const link = document.createElement("a")
+        link.className = "auth-other-button"
+        link.href = "/login/oidc/" + encodeURIComponent(provider.name)
+        link.innerText = "log in with " + provider.displayName
+        oidcProvidersDiv.appendChild(link)
+    }
+}
+
 loginForm.addEventListener("submit", onLoginSubmit)
+if (auth.passkeysSupported()) {
+    passkeyLoginLink.hidden = false
+    passkeyLoginLink.addEventListener("click", onPasskeyLoginClick)
+}
 themeSetting.runOnSet()
+await loadOIDCProviders()
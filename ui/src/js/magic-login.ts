@@ -0,0 +1,21 @@
+import { themeSetting } from "./settings.js"
+import * as docUtils from "./docUtils.js"
+import * as auth from "./auth.js"
+
+const magicLoginForm = docUtils.getForm("magic-login-form")
+const emailInput = docUtils.getInput("email-input")
+const errorMsgsDiv = docUtils.getDiv("magic-login-form-errors")
+
+async function onMagicLoginSubmit(event: Event) {
+    event.preventDefault()
+    errorMsgsDiv.innerText = ""
+    const errors = await auth.magicLogin(emailInput.value)
+    if (errors.length == 0) {
+        window.location.href = "/login-link-sent"
+    } else {
+        errorMsgsDiv.innerText = errors.join("\n")
+    }
+}
+
+magicLoginForm.addEventListener("submit", onMagicLoginSubmit)
+themeSetting.runOnSet()
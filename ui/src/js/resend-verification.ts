@@ -0,0 +1,21 @@
+import { themeSetting } from "./settings.js"
+import * as docUtils from "./docUtils.js"
+import * as auth from "./auth.js"
+
+const resendVerificationForm = docUtils.getForm("resend-verification-form")
+const emailInput = docUtils.getInput("email-input")
+const errorMsgsDiv = docUtils.getDiv("resend-verification-form-errors")
+
+async function onResendVerificationSubmit(event: Event) {
+    event.preventDefault()
+    errorMsgsDiv.innerText = ""
+    const errors = await auth.resendVerification(emailInput.value)
+    if (errors.length == 0) {
+        window.location.href = "/register-complete"
+    } else {
+        errorMsgsDiv.innerText = errors.join("\n")
+    }
+}
+
+resendVerificationForm.addEventListener("submit", onResendVerificationSubmit)
+themeSetting.runOnSet()
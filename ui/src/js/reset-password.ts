@@ -0,0 +1,22 @@
+import { themeSetting } from "./settings.js"
+import * as docUtils from "./docUtils.js"
+import * as auth from "./auth.js"
+
+const resetPasswordForm = docUtils.getForm("reset-password-form")
+const passwordInput = docUtils.getInput("pass-input")
+const errorMsgsDiv = docUtils.getDiv("reset-password-form-errors")
+
+async function onResetPasswordSubmit(event: Event) {
+    event.preventDefault()
+    errorMsgsDiv.innerText = ""
+    const token = new URLSearchParams(window.location.search).get("token") ?? ""
+    const errors = await auth.resetPassword(token, passwordInput.value)
+    if (errors.length == 0) {
+        window.location.href = "/password-reset-complete"
+    } else {
+        errorMsgsDiv.innerText = errors.join("\n")
+    }
+}
+
+resetPasswordForm.addEventListener("submit", onResetPasswordSubmit)
+themeSetting.runOnSet()
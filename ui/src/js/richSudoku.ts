@@ -791,6 +791,8 @@ class RichSudoku {
     hints: Hints
     timer: Timer
     difficulty: string
+    // the sudoku as served, before shuffling, empty if unknown
+    source: string
     conflicts: ConflictsTracker
     // has sudoku been solved before? useful when loading from cache
     previouslyDone: boolean
@@ -806,6 +808,7 @@ class RichSudoku {
         this.hints = new Hints(this.sudoku)
         this.timer = new Timer()
         this.difficulty = ""
+        this.source = ""
         this.conflicts = new ConflictsTracker(this.sudoku)
         this.regionHighlighter = new RegionHighlighter(this.sudoku)
         this.numberHighlighter = new NumberHighlighter(this.sudoku)
@@ -813,7 +816,10 @@ class RichSudoku {
         this.reloading = 0
     }
 
-    newGame(sudoku: Sudoku, freeze: boolean, difficulty: string, previouslyDone: boolean) {
+    newGame(
+        sudoku: Sudoku, freeze: boolean, difficulty: string, previouslyDone: boolean,
+        source: string = "",
+    ) {
         if (sudoku.n != this.sudoku.n) {
             throw new Error("inavlid sudoku size")
         }
@@ -833,6 +839,7 @@ class RichSudoku {
         this.timer = new Timer()
         this.timer.resume()
         this.difficulty = difficulty
+        this.source = source
         new SudokuGameLoadEvent().emit()
         this.reloading--
         this.save()
@@ -898,6 +905,7 @@ class RichSudoku {
                 "size": this.sudoku.n,
                 "values": this.sudoku.board,
                 "difficulty": this.difficulty,
+                "source": this.source,
             },
             "hints": this.hints.hints,
             "cursor": {
@@ -932,8 +940,9 @@ class RichSudoku {
         const size = obj["sudoku"]["size"]
         const board = obj["sudoku"]["values"]
         const difficulty = obj["sudoku"]["difficulty"]
+        const source = obj["sudoku"]["source"] ?? ""
         const sudoku = new Sudoku(size, board)
-        this.newGame(sudoku, false, difficulty, this.previouslyDone)
+        this.newGame(sudoku, false, difficulty, this.previouslyDone, source)
 
         // freezer
         const frozen = obj["frozen"]
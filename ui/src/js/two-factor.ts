@@ -0,0 +1,22 @@
+import { themeSetting } from "./settings.js"
+import * as docUtils from "./docUtils.js"
+import * as auth from "./auth.js"
+
+const twoFactorForm = docUtils.getForm("two-factor-form")
+const codeInput = docUtils.getInput("code-input")
+const errorMsgsDiv = docUtils.getDiv("two-factor-form-errors")
+
+async function onTwoFactorSubmit(event: Event) {
+    event.preventDefault()
+    errorMsgsDiv.innerText = ""
+    const challenge = window.location.hash.slice(1)
+    const errors = await auth.loginTwoFactor(challenge, codeInput.value)
+    if (errors.length == 0) {
+        window.location.href = "/"
+    } else {
+        errorMsgsDiv.innerText = errors.join("\n")
+    }
+}
+
+twoFactorForm.addEventListener("submit", onTwoFactorSubmit)
+themeSetting.runOnSet()
@@ -9,13 +9,12 @@ export function validateEmail(email: string): string[] {
     return errors
 }
 
+// Length limits are checked by the server, which sends them back with the
+// error, see passwordError in auth.ts.
 export function validatePassword(password: string): string[] {
     let errors: string[] = []
-    if (password.length < 8) {
-        errors.push("Password has to be at least 8 characters long.")
-    }
-    if (password.length > 128) {
-        errors.push("Password can be no longer than 128 characters.")
+    if (password.length == 0) {
+        errors.push("Enter a password.")
     }
     return errors
 }